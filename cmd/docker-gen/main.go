@@ -7,7 +7,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	docker "github.com/fsouza/go-dockerclient"
@@ -32,6 +34,22 @@ var (
 	configs               dockergen.ConfigFile
 	interval              int
 	keepBlankLines        bool
+	timeout               time.Duration
+	continueOnError       bool
+	skipIfEmpty           bool
+	minContainers         int
+	trimTrailingSpace     bool
+	metadataDir           string
+	allowedHostsFile      string
+	forceWrite            bool
+	emitDiff              bool
+	summaryDest           string
+	validate              bool
+	includeNameRegex      string
+	excludeNameRegex      string
+	fileMode              string
+	fileUID               int
+	fileGID               int
 	endpoint              string
 	tlsCert               string
 	tlsKey                string
@@ -92,6 +110,8 @@ func initFlags() {
 
 	flag.BoolVar(&onlyPublished, "only-published", false,
 		"only include containers with published ports (implies -only-exposed)")
+	flag.StringVar(&includeNameRegex, "include-name-regex", "", "only include containers whose name matches this regular expression")
+	flag.StringVar(&excludeNameRegex, "exclude-name-regex", "", "exclude containers whose name matches this regular expression")
 	flag.BoolVar(&includeStopped, "include-stopped", false, "include stopped containers")
 	flag.BoolVar(&notifyOutput, "notify-output", false, "log the output(stdout/stderr) of notify command")
 	flag.StringVar(&notifyCmd, "notify", "", "run command after template is regenerated (e.g `restart xyz`)")
@@ -104,6 +124,20 @@ func initFlags() {
 	flag.Var(&configFiles, "config", "config files with template directives. Config files will be merged if this option is specified multiple times.")
 	flag.IntVar(&interval, "interval", 0, "notify command interval (secs)")
 	flag.BoolVar(&keepBlankLines, "keep-blank-lines", false, "keep blank lines in the output file")
+	flag.BoolVar(&skipIfEmpty, "skip-if-empty", false, "do not write the output file when the template renders empty contents")
+	flag.BoolVar(&trimTrailingSpace, "trim-trailing-whitespace", false, "remove trailing spaces and tabs from every line of the output file")
+	flag.StringVar(&metadataDir, "metadata-dir", "", "directory containing additional container labels as <container-ID>.json files")
+	flag.StringVar(&allowedHostsFile, "allowed-hosts-file", "", "file listing the hosts allowed by the isAllowedHost function, one per line")
+	flag.IntVar(&minContainers, "min-containers", 0, "do not write the output file when fewer containers match")
+	flag.StringVar(&summaryDest, "summary-dest", "", "write a JSON summary of every generation to this file")
+	flag.StringVar(&fileMode, "file-mode", "", "octal mode of the output file (e.g. \"0644\"). Default the mode of the existing file")
+	flag.IntVar(&fileUID, "file-uid", -1, "user ID owning the output file. Default the owner of the existing file")
+	flag.IntVar(&fileGID, "file-gid", -1, "group ID owning the output file. Default the group of the existing file")
+	flag.BoolVar(&emitDiff, "emit-diff", false, "log a unified diff of the output file whenever it changes")
+	flag.BoolVar(&forceWrite, "force-write", false, "replace the output file on start even when its contents are unchanged")
+	flag.BoolVar(&validate, "validate", false, "check the templates for errors without connecting to docker, then exit")
+	flag.BoolVar(&continueOnError, "continue-on-error", false, "log template errors and keep the previous output file instead of exiting")
+	flag.DurationVar(&timeout, "timeout", 0, "maximum duration of a template execution (e.g. \"5s\"). Default no timeout")
 	flag.StringVar(&endpoint, "endpoint", "", "docker api endpoint (tcp|unix://..). Default unix:///var/run/docker.sock")
 	flag.StringVar(&tlsCert, "tlscert", filepath.Join(certPath, "cert.pem"), "path to TLS client certificate file")
 	flag.StringVar(&tlsKey, "tlskey", filepath.Join(certPath, "key.pem"), "path to TLS client key file")
@@ -144,18 +178,43 @@ func main() {
 			log.Fatalf("Error parsing wait interval: %s\n", err)
 		}
 		config := dockergen.Config{
-			Template:         flag.Arg(0),
-			Dest:             flag.Arg(1),
-			Watch:            watch,
-			Wait:             w,
-			NotifyCmd:        notifyCmd,
-			NotifyOutput:     notifyOutput,
-			NotifyContainers: make(map[string]int),
-			OnlyExposed:      onlyExposed,
-			OnlyPublished:    onlyPublished,
-			IncludeStopped:   includeStopped,
-			Interval:         interval,
-			KeepBlankLines:   keepBlankLines,
+			Template:               flag.Arg(0),
+			Dest:                   flag.Arg(1),
+			Watch:                  watch,
+			Wait:                   w,
+			NotifyCmd:              notifyCmd,
+			NotifyOutput:           notifyOutput,
+			NotifyContainers:       make(map[string]int),
+			OnlyExposed:            onlyExposed,
+			OnlyPublished:          onlyPublished,
+			IncludeStopped:         includeStopped,
+			IncludeNameRegex:       includeNameRegex,
+			ExcludeNameRegex:       excludeNameRegex,
+			Interval:               interval,
+			KeepBlankLines:         keepBlankLines,
+			Timeout:                dockergen.Duration(timeout),
+			ContinueOnError:        continueOnError,
+			SkipIfEmpty:            skipIfEmpty,
+			MinContainers:          minContainers,
+			TrimTrailingWhitespace: trimTrailingSpace,
+			MetadataDir:            metadataDir,
+			AllowedHostsFile:       allowedHostsFile,
+			ForceWrite:             forceWrite,
+			EmitDiff:               emitDiff,
+			SummaryDest:            summaryDest,
+		}
+		if fileMode != "" {
+			mode, err := strconv.ParseUint(fileMode, 8, 32)
+			if err != nil {
+				log.Fatalf("Error parsing file mode: %s\n", err)
+			}
+			config.FileMode = os.FileMode(mode)
+		}
+		if fileUID >= 0 {
+			config.FileUID = &fileUID
+		}
+		if fileGID >= 0 {
+			config.FileGID = &fileGID
 		}
 		if notifyContainerID != "" {
 			config.NotifyContainers[notifyContainerID] = notifyContainerSignal
@@ -164,6 +223,20 @@ func main() {
 			Config: []dockergen.Config{config}}
 	}
 
+	if validate {
+		failed := false
+		for _, config := range configs.Config {
+			if err := dockergen.ValidateTemplate(config); err != nil {
+				log.Printf("Invalid template %s: %s\n", config.Template, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
 	all := true
 	for _, config := range configs.Config {
 		if config.IncludeStopped {
@@ -2,23 +2,40 @@ package dockergen
 
 import (
 	"errors"
+	"os"
 	"strings"
 	"time"
 )
 
 type Config struct {
-	Template         string
-	Dest             string
-	Watch            bool
-	Wait             *Wait
-	NotifyCmd        string
-	NotifyOutput     bool
-	NotifyContainers map[string]int
-	OnlyExposed      bool
-	OnlyPublished    bool
-	IncludeStopped   bool
-	Interval         int
-	KeepBlankLines   bool
+	Template               string
+	Dest                   string
+	Watch                  bool
+	Wait                   *Wait
+	NotifyCmd              string
+	NotifyOutput           bool
+	NotifyContainers       map[string]int
+	OnlyExposed            bool
+	OnlyPublished          bool
+	IncludeStopped         bool
+	Interval               int
+	KeepBlankLines         bool
+	Diff                   bool
+	EmitDiff               bool
+	Timeout                Duration
+	ContinueOnError        bool
+	SkipIfEmpty            bool
+	MinContainers          int
+	TrimTrailingWhitespace bool
+	MetadataDir            string
+	AllowedHostsFile       string
+	ForceWrite             bool
+	SummaryDest            string
+	IncludeNameRegex       string
+	ExcludeNameRegex       string
+	FileMode               os.FileMode
+	FileUID                *int
+	FileGID                *int
 }
 
 type ConfigFile struct {
@@ -43,6 +60,17 @@ type Wait struct {
 	Max time.Duration
 }
 
+// Duration is a time.Duration read from config files as a string, e.g. "5s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err == nil {
+		*d = Duration(duration)
+	}
+	return err
+}
+
 func (w *Wait) UnmarshalText(text []byte) error {
 	wait, err := ParseWait(string(text))
 	if err == nil {
@@ -2,7 +2,9 @@ package dockergen
 
 import (
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,3 +43,13 @@ func TestWaitUnmarshalText(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedWait, wait)
 }
+
+func TestDurationUnmarshalText(t *testing.T) {
+	var configs ConfigFile
+	_, err := toml.Decode("[[config]]\ntimeout = \"5s\"\n", &configs)
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(5*time.Second), configs.Config[0].Timeout)
+
+	_, err = toml.Decode("[[config]]\ntimeout = \"5x\"\n", &configs)
+	assert.Error(t, err)
+}
@@ -23,11 +23,27 @@ func (c *Context) Env() map[string]string {
 }
 
 func (c *Context) Docker() Docker {
+	return currentDocker()
+}
+
+// currentDocker returns the information last set by SetServerInfo
+func currentDocker() Docker {
 	mu.RLock()
 	defer mu.RUnlock()
 	return dockerInfo
 }
 
+// Filter returns a new Context holding the containers for which pred returns true
+func (c *Context) Filter(pred func(*RuntimeContainer) bool) Context {
+	filtered := Context{}
+	for _, container := range *c {
+		if pred(container) {
+			filtered = append(filtered, container)
+		}
+	}
+	return filtered
+}
+
 func SetServerInfo(d *docker.DockerInfo) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -80,6 +96,14 @@ type Volume struct {
 
 type State struct {
 	Running bool
+	Health  Health
+}
+
+// Health is the result of the healthcheck of a container. Status is empty
+// when the container has no healthcheck, and one of "starting", "healthy" or
+// "unhealthy" otherwise.
+type Health struct {
+	Status string
 }
 
 type RuntimeContainer struct {
@@ -115,6 +139,22 @@ func (r *RuntimeContainer) PublishedAddresses() []Address {
 	return mapped
 }
 
+// ShortID returns the first 12 characters of the container ID, as shown by docker ps
+func (r RuntimeContainer) ShortID() string {
+	if len(r.ID) > 12 {
+		return r.ID[:12]
+	}
+	return r.ID
+}
+
+// String returns the container name followed by its short ID, e.g. "web (0123456789ab)"
+func (r RuntimeContainer) String() string {
+	if r.Name == "" {
+		return r.ShortID()
+	}
+	return fmt.Sprintf("%s (%s)", r.Name, r.ShortID())
+}
+
 type DockerImage struct {
 	Registry   string
 	Repository string
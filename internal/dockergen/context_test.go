@@ -163,3 +163,45 @@ func TestPublishedAddresses(t *testing.T) {
 
 	assert.ElementsMatch(t, expected, container.PublishedAddresses())
 }
+
+func TestContextFilter(t *testing.T) {
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+		{ID: "2"},
+		{ID: "3", State: State{Running: true}},
+	}
+
+	running := containers.Filter(func(container *RuntimeContainer) bool {
+		return container.State.Running
+	})
+	assert.Len(t, running, 2)
+	assert.Equal(t, "1", running[0].ID)
+	assert.Equal(t, "3", running[1].ID)
+
+	all := containers.Filter(func(*RuntimeContainer) bool { return true })
+	assert.Equal(t, containers, all)
+
+	none := containers.Filter(func(*RuntimeContainer) bool { return false })
+	assert.NotNil(t, none)
+	assert.Empty(t, none)
+
+	empty := Context{}
+	assert.Empty(t, empty.Filter(func(*RuntimeContainer) bool { return true }))
+
+	all[0] = &RuntimeContainer{ID: "4"}
+	assert.Equal(t, "1", containers[0].ID, "the filtered Context should be a copy")
+}
+
+func TestRuntimeContainerString(t *testing.T) {
+	container := &RuntimeContainer{
+		ID:   "0123456789abcdef0123456789abcdef",
+		Name: "web",
+	}
+	assert.Equal(t, "0123456789ab", container.ShortID())
+	assert.Equal(t, "web (0123456789ab)", container.String())
+	assert.Equal(t, "web (0123456789ab)", fmt.Sprint(container))
+
+	container = &RuntimeContainer{ID: "0123"}
+	assert.Equal(t, "0123", container.ShortID())
+	assert.Equal(t, "0123", container.String())
+}
@@ -21,9 +21,12 @@ type generator struct {
 	TLSVerify                  bool
 	TLSCert, TLSCaCert, TLSKey string
 	All                        bool
+	Observers                  []GenerationObserver
 
 	wg    sync.WaitGroup
 	retry bool
+	// destinations already generated once, after which ForceWrite no longer applies
+	generated sync.Map
 }
 
 type GeneratorConfig struct {
@@ -36,6 +39,13 @@ type GeneratorConfig struct {
 	All       bool
 
 	ConfigFile ConfigFile
+	Observers  []GenerationObserver
+}
+
+// GenerationObserver is notified after each generation of a config's template.
+// Configs are generated from several goroutines, so OnGenerate may be called concurrently.
+type GenerationObserver interface {
+	OnGenerate(config Config, changed bool, err error)
 }
 
 func NewGenerator(gc GeneratorConfig) (*generator, error) {
@@ -66,6 +76,7 @@ func NewGenerator(gc GeneratorConfig) (*generator, error) {
 		TLSKey:    gc.TLSKey,
 		All:       gc.All,
 		Configs:   gc.ConfigFile,
+		Observers: gc.Observers,
 		retry:     true,
 	}, nil
 }
@@ -120,8 +131,11 @@ func (g *generator) generateFromContainers() {
 		return
 	}
 	for _, config := range g.Configs.Config {
-		changed := GenerateFile(config, containers)
-		if !changed {
+		result := g.generateFile(config, containers)
+		if result.Err != nil {
+			continue
+		}
+		if !result.Changed {
 			log.Printf("Contents of %s did not change. Skipping notification '%s'", config.Dest, config.NotifyCmd)
 			continue
 		}
@@ -130,6 +144,20 @@ func (g *generator) generateFromContainers() {
 	}
 }
 
+// generateFile generates the template of config and notifies the observers
+func (g *generator) generateFile(config Config, containers Context) GenerateResult {
+	// ForceWrite only applies on start, so that unchanged contents do not
+	// trigger the notifications of every later event
+	if _, done := g.generated.LoadOrStore(config.Dest, true); done {
+		config.ForceWrite = false
+	}
+	result := GenerateFileResult(config, containers)
+	for _, observer := range g.Observers {
+		observer.OnGenerate(config, result.Changed, result.Err)
+	}
+	return result
+}
+
 func (g *generator) generateAtInterval() {
 	for _, config := range g.Configs.Config {
 
@@ -153,7 +181,7 @@ func (g *generator) generateAtInterval() {
 						continue
 					}
 					// ignore changed return value. always run notify command
-					GenerateFile(config, containers)
+					g.generateFile(config, containers)
 					g.runNotifyCmd(config)
 					g.sendSignalToContainer(config)
 				case sig := <-sigChan:
@@ -197,8 +225,11 @@ func (g *generator) generateFromEvents() {
 					log.Printf("Error listing containers: %s\n", err)
 					continue
 				}
-				changed := GenerateFile(config, containers)
-				if !changed {
+				result := g.generateFile(config, containers)
+				if result.Err != nil {
+					continue
+				}
+				if !result.Changed {
 					log.Printf("Contents of %s did not change. Skipping notification '%s'", config.Dest, config.NotifyCmd)
 					continue
 				}
@@ -384,6 +415,9 @@ func (g *generator) getContainers() ([]*RuntimeContainer, error) {
 			},
 			State: State{
 				Running: container.State.Running,
+				Health: Health{
+					Status: container.State.Health.Status,
+				},
 			},
 			Name:         strings.TrimLeft(container.Name, "/"),
 			Hostname:     container.Config.Hostname,
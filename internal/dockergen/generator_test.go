@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -205,3 +206,80 @@ func TestGenerateFromEvents(t *testing.T) {
 		}
 	}
 }
+
+type recordingObserver struct {
+	changes []bool
+}
+
+func (o *recordingObserver) OnGenerate(config Config, changed bool, err error) {
+	o.changes = append(o.changes, changed)
+}
+
+func TestGenerateFileObservers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := filepath.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observer := &recordingObserver{}
+	generator := &generator{
+		Observers: []GenerationObserver{observer},
+	}
+	config := Config{
+		Template: tmplPath,
+		Dest:     filepath.Join(dir, "test.out"),
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+	}
+
+	generator.generateFile(config, containers)
+	generator.generateFile(config, containers)
+
+	if len(observer.changes) != 2 || !observer.changes[0] || observer.changes[1] {
+		t.Errorf("expected observer to record [true false], got %v", observer.changes)
+	}
+}
+
+func TestGenerateFileForceWriteOnStart(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := filepath.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		Template:   tmplPath,
+		Dest:       filepath.Join(dir, "test.out"),
+		ForceWrite: true,
+	}
+	err = ioutil.WriteFile(config.Dest, []byte("1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+	}
+
+	generator := &generator{}
+	if result := generator.generateFile(config, containers); !result.Changed {
+		t.Error("expected the first generation to be forced")
+	}
+	if result := generator.generateFile(config, containers); result.Changed {
+		t.Error("expected later generations of unchanged contents not to be forced")
+	}
+}
@@ -2,24 +2,90 @@ package dockergen
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/template"
+	"text/template/parse"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// maxCachedRegexps bounds the number of compiled patterns kept by compileRegexp;
+// the cache is cleared once it is full so that templates building patterns from
+// container data cannot grow it without limit
+const maxCachedRegexps = 256
+
+var regexpCache = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// compileRegexp compiles a regular expression, reusing earlier compilations of
+// the same pattern
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	rx, ok := regexpCache.m[pattern]
+	regexpCache.Unlock()
+	if ok {
+		return rx, nil
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Lock()
+	if len(regexpCache.m) >= maxCachedRegexps {
+		regexpCache.m = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.m[pattern] = rx
+	regexpCache.Unlock()
+	return rx, nil
+}
+
+// regexMatchCompiled returns whether s matches a regular expression compiled with compileRegex
+func regexMatchCompiled(rx *regexp.Regexp, s string) bool {
+	return rx.MatchString(s)
+}
+
+// regexFindAll returns the successive matches of a regular expression in s,
+// at most n of them unless n is negative
+func regexFindAll(pattern, s string, n int) ([]string, error) {
+	rx, err := compileRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches := rx.FindAllString(s, n)
+	if matches == nil {
+		return []string{}, nil
+	}
+	return matches, nil
+}
+
 func getArrayValues(funcName string, entries interface{}) (*reflect.Value, error) {
 	entriesVal := reflect.ValueOf(entries)
 
@@ -61,9 +127,14 @@ func generalizedGroupBy(funcName string, entries interface{}, getValue func(inte
 	return groups, nil
 }
 
+// generalizedGroupByKey groups by the path property key. Values which are not
+// strings, e.g. numbers, are grouped by their default string format.
 func generalizedGroupByKey(funcName string, entries interface{}, key string, addEntry func(map[string][]interface{}, interface{}, interface{})) (map[string][]interface{}, error) {
 	getKey := func(v interface{}) (interface{}, error) {
-		return deepGet(v, key), nil
+		if value := deepGet(v, key); value != nil {
+			return fmt.Sprintf("%v", value), nil
+		}
+		return nil, nil
 	}
 	return generalizedGroupBy(funcName, entries, getKey, addEntry)
 }
@@ -97,6 +168,27 @@ func splitKeyValuePairs(input string, listSep string, kvpSep string, defaultKey
 	return output
 }
 
+// KeyValuePair is a single pair returned by parseKeyValuePairs
+type KeyValuePair struct {
+	Key   string
+	Value string
+}
+
+// parseKeyValuePairs is the same as splitKeyValuePairs without a default key, but returns the pairs
+// in input order and keeps duplicate keys. List items are split at the first kvpSep.
+func parseKeyValuePairs(input string, listSep string, kvpSep string) []KeyValuePair {
+	pairs := []KeyValuePair{}
+	for _, kvp := range strings.Split(input, listSep) {
+		if strings.Contains(kvp, kvpSep) {
+			splitted := strings.SplitN(kvp, kvpSep, 2)
+			pairs = append(pairs, KeyValuePair{Key: splitted[0], Value: splitted[1]})
+		} else {
+			pairs = append(pairs, KeyValuePair{Key: kvp, Value: kvp})
+		}
+	}
+	return pairs
+}
+
 // groupByMultiKeyValuePairs similar to groupByMulti, but the key value ist split into a list (delimited by listSep) of key value pairs (seperated by kvpSep: <key>kvpSep<value, e.g key1=value1>)
 // An array or slice entry will show up in the output map under all of the list key value pair keys
 func groupByMultiKeyValuePairs(entries interface{}, key, listSep string, kvpSep string, defaultKey string) (map[string][]interface{}, error) {
@@ -109,6 +201,25 @@ func groupByMultiKeyValuePairs(entries interface{}, key, listSep string, kvpSep
 	})
 }
 
+// KeyValueEntry is an entry grouped by groupByMultiKeyValuePairsWithValue along
+// with the value paired with the key it was grouped under
+type KeyValueEntry struct {
+	Container interface{}
+	Value     string
+}
+
+// groupByMultiKeyValuePairsWithValue is the same as groupByMultiKeyValuePairs, but each entry is
+// returned as a KeyValueEntry holding the value paired with the key it is grouped under
+func groupByMultiKeyValuePairsWithValue(entries interface{}, key, listSep string, kvpSep string, defaultKey string) (map[string][]interface{}, error) {
+	return generalizedGroupByKey("groupByMultiKeyValuePairsWithValue", entries, key, func(groups map[string][]interface{}, value interface{}, v interface{}) {
+
+		keyValuePairs := splitKeyValuePairs(value.(string), listSep, kvpSep, defaultKey)
+		for key, value := range keyValuePairs {
+			groups[key] = append(groups[key], KeyValueEntry{Container: v, Value: value})
+		}
+	})
+}
+
 // groupByMulti groups a generic array or slice by the path property keys value, where the path value is first split by sep into a list of key strings.
 // An array or slice entry will show up in the output map under all of the list keys
 func groupByMulti(entries interface{}, key, sep string) (map[string][]interface{}, error) {
@@ -127,6 +238,59 @@ func groupBy(entries interface{}, key string) (map[string][]interface{}, error)
 	})
 }
 
+// CountedGroup is a single group returned by groupByWithCount
+type CountedGroup struct {
+	Containers []interface{}
+	Count      int
+}
+
+// groupByWithCount is the same as groupBy but every group also holds its size
+func groupByWithCount(entries interface{}, key string) (map[string]CountedGroup, error) {
+	groups, err := groupBy(entries, key)
+	if err != nil {
+		return nil, err
+	}
+
+	counted := make(map[string]CountedGroup, len(groups))
+	for k, values := range groups {
+		counted[k] = CountedGroup{Containers: values, Count: len(values)}
+	}
+	return counted, nil
+}
+
+// OrderedGroup is a single group returned by groupByOrdered
+type OrderedGroup struct {
+	Key    string
+	Values []interface{}
+}
+
+// groupByOrdered is the same as groupBy but returns a slice of groups, ordered
+// by the position at which each key is first encountered in entries
+func groupByOrdered(entries interface{}, key string) ([]OrderedGroup, error) {
+	entriesVal, err := getArrayValues("groupByOrdered", entries)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []OrderedGroup{}
+	index := make(map[string]int)
+	for i := 0; i < entriesVal.Len(); i++ {
+		v := reflect.Indirect(entriesVal.Index(i)).Interface()
+		value := deepGet(v, key)
+		if value == nil {
+			continue
+		}
+		k := fmt.Sprintf("%v", value)
+		if n, ok := index[k]; ok {
+			groups[n].Values = append(groups[n].Values, v)
+		} else {
+			index[k] = len(groups)
+			groups = append(groups, OrderedGroup{Key: k, Values: []interface{}{v}})
+		}
+	}
+	return groups, nil
+}
+
 // groupByKeys is the same as groupBy but only returns a list of keys
 func groupByKeys(entries interface{}, key string) ([]string, error) {
 	keys, err := generalizedGroupByKey("groupByKeys", entries, key, func(groups map[string][]interface{}, value interface{}, v interface{}) {
@@ -160,6 +324,198 @@ func groupByLabel(entries interface{}, label string) (map[string][]interface{},
 	})
 }
 
+// labelTransforms are the template functions groupByLabelWithTransform may
+// apply to label values, by name
+var labelTransforms = map[string]func(string) string{
+	"base32Encode":      base32Encode,
+	"hexEncode":         hexEncode,
+	"jsonEscape":        jsonEscape,
+	"queryEscape":       url.QueryEscape,
+	"sha1":              hashSha1,
+	"toLower":           toLower,
+	"toUpper":           toUpper,
+	"trim":              trim,
+	"trimTrailingSpace": trimTrailingSpace,
+}
+
+// groupByLabelWithTransform is the same as groupByLabel but the label's value
+// is first passed through the string function named transformFn, e.g. toLower
+func groupByLabelWithTransform(entries interface{}, label, transformFn string) (map[string][]interface{}, error) {
+	transform, ok := labelTransforms[transformFn]
+	if !ok {
+		return nil, fmt.Errorf("unknown function passed to 'groupByLabelWithTransform'; received %v", transformFn)
+	}
+
+	getLabel := func(v interface{}) (interface{}, error) {
+		if container, ok := v.(RuntimeContainer); ok {
+			if value, ok := container.Labels[label]; ok {
+				return transform(value), nil
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to 'groupByLabelWithTransform'; received %v", v)
+	}
+	return generalizedGroupBy("groupByLabelWithTransform", entries, getLabel, func(groups map[string][]interface{}, value interface{}, v interface{}) {
+		groups[value.(string)] = append(groups[value.(string)], v)
+	})
+}
+
+// countByLabel returns the number of containers per value of the given label.
+// Containers without the label are skipped.
+func countByLabel(entries interface{}, label string) (map[string]int, error) {
+	entriesVal, err := getArrayValues("countByLabel", entries)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < entriesVal.Len(); i++ {
+		v := reflect.Indirect(entriesVal.Index(i)).Interface()
+		container, ok := v.(RuntimeContainer)
+		if !ok {
+			return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to 'countByLabel'; received %v", v)
+		}
+		if value, ok := container.Labels[label]; ok {
+			counts[value]++
+		}
+	}
+	return counts, nil
+}
+
+// countLabelValueMatches returns the number of containers with a particular
+// label whose value matches a regular expression
+func countLabelValueMatches(entries interface{}, label, pattern string) (int, error) {
+	match, err := labelValueMatcher("countLabelValueMatches", pattern, false)
+	if err != nil {
+		return 0, err
+	}
+	containers, err := toContext("countLabelValueMatches", entries)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, container := range containers {
+		if value, ok := container.Labels[label]; ok && match(value) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// groupByLabels is the same as groupByLabel but groups by the values of several
+// labels joined by sep. A missing label contributes an empty segment.
+func groupByLabels(entries interface{}, labels []string, sep string) (map[string][]interface{}, error) {
+	getLabels := func(v interface{}) (interface{}, error) {
+		if container, ok := v.(RuntimeContainer); ok {
+			values := make([]string, len(labels))
+			for i, label := range labels {
+				values[i] = container.Labels[label]
+			}
+			return strings.Join(values, sep), nil
+		}
+		return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to 'groupByLabels'; received %v", v)
+	}
+	return generalizedGroupBy("groupByLabels", entries, getLabels, func(groups map[string][]interface{}, value interface{}, v interface{}) {
+		groups[value.(string)] = append(groups[value.(string)], v)
+	})
+}
+
+// groupByLabelMultiTrimmed is the same as groupByLabel but the label's value is
+// first split by sep, like groupByMulti. Items are trimmed, empty items are
+// skipped and a container is filed at most once under each item.
+func groupByLabelMultiTrimmed(entries interface{}, label, sep string) (map[string][]interface{}, error) {
+	getLabel := func(v interface{}) (interface{}, error) {
+		if container, ok := v.(RuntimeContainer); ok {
+			if value, ok := container.Labels[label]; ok {
+				return value, nil
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to 'groupByLabelMultiTrimmed'; received %v", v)
+	}
+	return generalizedGroupBy("groupByLabelMultiTrimmed", entries, getLabel, func(groups map[string][]interface{}, value interface{}, v interface{}) {
+		seen := make(map[string]bool)
+		for _, item := range strings.Split(value.(string), sep) {
+			item = strings.TrimSpace(item)
+			if item == "" || seen[item] {
+				continue
+			}
+			seen[item] = true
+			groups[item] = append(groups[item], v)
+		}
+	})
+}
+
+// groupByLabelValueCapture is the same as groupByLabel but groups by the first
+// capture group of pattern matched against the label's value. Containers whose
+// label value does not match are omitted.
+func groupByLabelValueCapture(entries interface{}, label, pattern string) (map[string][]interface{}, error) {
+	return generalizedGroupByLabelValueCapture("groupByLabelValueCapture", entries, label, pattern)
+}
+
+// groupByLabelValueCaptureSorted is the same as groupByLabelValueCapture but
+// returns a slice of groups, ordered by their captured key
+func groupByLabelValueCaptureSorted(entries interface{}, label, pattern string) ([]OrderedGroup, error) {
+	groups, err := generalizedGroupByLabelValueCapture("groupByLabelValueCaptureSorted", entries, label, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]OrderedGroup, len(keys))
+	for i, k := range keys {
+		sorted[i] = OrderedGroup{Key: k, Values: groups[k]}
+	}
+	return sorted, nil
+}
+
+func generalizedGroupByLabelValueCapture(funcName string, entries interface{}, label, pattern string) (map[string][]interface{}, error) {
+	rx, err := compileRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if rx.NumSubexp() < 1 {
+		return nil, fmt.Errorf("pattern passed to '%v' must have a capture group; received %v", funcName, pattern)
+	}
+
+	getCapture := func(v interface{}) (interface{}, error) {
+		if container, ok := v.(RuntimeContainer); ok {
+			if value, ok := container.Labels[label]; ok {
+				if match := rx.FindStringSubmatch(value); match != nil {
+					return match[1], nil
+				}
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to '%v'; received %v", funcName, v)
+	}
+	return generalizedGroupBy(funcName, entries, getCapture, func(groups map[string][]interface{}, value interface{}, v interface{}) {
+		groups[value.(string)] = append(groups[value.(string)], v)
+	})
+}
+
+// field returns the value of the path property of item, following pointers.
+// It returns nil if item is nil or the path does not exist.
+func field(item interface{}, path string) interface{} {
+	v := reflect.ValueOf(item)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	return deepGet(v.Interface(), path)
+}
+
 // Generalized where function
 func generalizedWhere(funcName string, entries interface{}, key string, test func(interface{}) bool) (interface{}, error) {
 	entriesVal, err := getArrayValues(funcName, entries)
@@ -209,6 +565,83 @@ func whereNotExist(entries interface{}, key string) (interface{}, error) {
 	})
 }
 
+// selects entries where a key is an array or slice containing an item
+func whereSliceContains(entries interface{}, key string, item interface{}) (interface{}, error) {
+	return generalizedWhere("whereSliceContains", entries, key, func(value interface{}) bool {
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Array && v.Kind() != reflect.Slice {
+			return false
+		}
+		for i := 0; i < v.Len(); i++ {
+			if reflect.DeepEqual(v.Index(i).Interface(), item) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// selects containers with a particular environment variable equal to a value
+func whereEnv(containers interface{}, key, value string) (Context, error) {
+	return generalizedWhereContainer("whereEnv", containers, func(container *RuntimeContainer) bool {
+		v, ok := container.Env[key]
+		return ok && v == value
+	})
+}
+
+// selects containers without a particular environment variable equal to a
+// value; containers missing the variable are selected
+func whereEnvNot(containers interface{}, key, value string) (Context, error) {
+	return generalizedWhereContainer("whereEnvNot", containers, func(container *RuntimeContainer) bool {
+		v, ok := container.Env[key]
+		return !ok || v != value
+	})
+}
+
+// selects containers that have a particular environment variable
+func whereEnvExists(containers interface{}, key string) (Context, error) {
+	return generalizedWhereContainer("whereEnvExists", containers, func(container *RuntimeContainer) bool {
+		_, ok := container.Env[key]
+		return ok
+	})
+}
+
+// selects containers that don't have a particular environment variable
+func whereEnvDoesNotExist(containers interface{}, key string) (Context, error) {
+	return generalizedWhereContainer("whereEnvDoesNotExist", containers, func(container *RuntimeContainer) bool {
+		_, ok := container.Env[key]
+		return !ok
+	})
+}
+
+// selects containers with a particular environment variable whose value
+// matches a regular expression
+func whereEnvValueMatches(containers interface{}, key, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereEnvValueMatches", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereContainer("whereEnvValueMatches", containers, func(container *RuntimeContainer) bool {
+		value, ok := container.Env[key]
+		return ok && match(value)
+	})
+}
+
+// selects containers without a particular environment variable whose value
+// matches a regular expression; containers missing the variable are selected
+func whereEnvValueNotMatches(containers interface{}, key, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereEnvValueNotMatches", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereContainer("whereEnvValueNotMatches", containers, func(container *RuntimeContainer) bool {
+		value, ok := container.Env[key]
+		return !ok || !match(value)
+	})
+}
+
 // selects entries based on key.  Assumes key is delimited and breaks it apart before comparing
 func whereAny(entries interface{}, key, sep string, cmp []string) (interface{}, error) {
 	return generalizedWhere("whereAny", entries, key, func(value interface{}) bool {
@@ -234,97 +667,884 @@ func whereAll(entries interface{}, key, sep string, cmp []string) (interface{},
 	})
 }
 
-// generalized whereLabel function
-func generalizedWhereLabel(funcName string, containers Context, label string, test func(string, bool) bool) (Context, error) {
-	selection := make([]*RuntimeContainer, 0)
-
-	for i := 0; i < len(containers); i++ {
-		container := containers[i]
-
-		value, ok := container.Labels[label]
-		if test(value, ok) {
-			selection = append(selection, container)
-		}
+// toNumber returns the number held by value, a number or a string holding one
+func toNumber(value interface{}) (float64, bool) {
+	if value == nil {
+		return 0, false
 	}
-
-	return selection, nil
+	n, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(value)), 64)
+	return n, err == nil
 }
 
-// selects containers that have a particular label
-func whereLabelExists(containers Context, label string) (Context, error) {
-	return generalizedWhereLabel("whereLabelExists", containers, label, func(_ string, ok bool) bool {
-		return ok
+// selects entries where a key is a number, or a string holding one, within
+// [low, high]
+func whereNumInRange(entries interface{}, key string, low, high float64) (interface{}, error) {
+	return generalizedWhere("whereNumInRange", entries, key, func(value interface{}) bool {
+		n, ok := toNumber(value)
+		return ok && n >= low && n <= high
 	})
 }
 
-// selects containers that have don't have a particular label
-func whereLabelDoesNotExist(containers Context, label string) (Context, error) {
-	return generalizedWhereLabel("whereLabelDoesNotExist", containers, label, func(_ string, ok bool) bool {
-		return !ok
-	})
-}
+// generalized numeric comparison where function. Entries where the key is not
+// a number, or a string holding one, are not selected.
+func generalizedWhereCompare(funcName string, entries interface{}, key, op string, cmp interface{}) (interface{}, error) {
+	threshold, ok := toNumber(cmp)
+	if !ok {
+		return nil, fmt.Errorf("must pass a number to '%v'; received %v", funcName, cmp)
+	}
 
-// selects containers with a particular label whose value matches a regular expression
-func whereLabelValueMatches(containers Context, label, pattern string) (Context, error) {
-	rx, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, err
+	var compare func(n float64) bool
+	switch op {
+	case ">":
+		compare = func(n float64) bool { return n > threshold }
+	case ">=":
+		compare = func(n float64) bool { return n >= threshold }
+	case "<":
+		compare = func(n float64) bool { return n < threshold }
+	case "<=":
+		compare = func(n float64) bool { return n <= threshold }
+	default:
+		return nil, fmt.Errorf("invalid operator passed to '%v': %q; must be one of >, >=, < or <=", funcName, op)
 	}
 
-	return generalizedWhereLabel("whereLabelValueMatches", containers, label, func(value string, ok bool) bool {
-		return ok && rx.MatchString(value)
+	return generalizedWhere(funcName, entries, key, func(value interface{}) bool {
+		n, ok := toNumber(value)
+		return ok && compare(n)
 	})
 }
 
-// hasPrefix returns whether a given string is a prefix of another string
-func hasPrefix(prefix, s string) bool {
-	return strings.HasPrefix(s, prefix)
+// selects entries where a key is a number comparing to cmp with the operator
+// op, one of >, >=, < or <=
+func whereCompare(entries interface{}, key, op string, cmp interface{}) (interface{}, error) {
+	return generalizedWhereCompare("whereCompare", entries, key, op, cmp)
 }
 
-// hasSuffix returns whether a given string is a suffix of another string
-func hasSuffix(suffix, s string) bool {
-	return strings.HasSuffix(s, suffix)
+// selects entries where a key is a number greater than cmp
+func whereGreaterThan(entries interface{}, key string, cmp interface{}) (interface{}, error) {
+	return generalizedWhereCompare("whereGreaterThan", entries, key, ">", cmp)
 }
 
-func keys(input interface{}) (interface{}, error) {
-	if input == nil {
-		return nil, nil
-	}
+// selects entries where a key is a number less than cmp
+func whereLessThan(entries interface{}, key string, cmp interface{}) (interface{}, error) {
+	return generalizedWhereCompare("whereLessThan", entries, key, "<", cmp)
+}
 
-	val := reflect.ValueOf(input)
-	if val.Kind() != reflect.Map {
-		return nil, fmt.Errorf("cannot call keys on a non-map value: %v", input)
+// duplicatePublishedPorts returns the containers publishing each host ip and
+// port that is published by more than one container, keyed by "HostIP:HostPort"
+func duplicatePublishedPorts(entries interface{}) (map[string][]interface{}, error) {
+	containers, err := toContext("duplicatePublishedPorts", entries)
+	if err != nil {
+		return nil, err
 	}
 
-	vk := val.MapKeys()
-	k := make([]interface{}, val.Len())
-	for i := range k {
-		k[i] = vk[i].Interface()
+	published := make(map[string][]interface{})
+	for _, container := range containers {
+		seen := make(map[string]bool)
+		for _, address := range container.PublishedAddresses() {
+			key := address.HostIP + ":" + address.HostPort
+			if !seen[key] {
+				seen[key] = true
+				published[key] = append(published[key], *container)
+			}
+		}
 	}
 
-	return k, nil
+	for key, group := range published {
+		if len(group) < 2 {
+			delete(published, key)
+		}
+	}
+	return published, nil
 }
 
-func intersect(l1, l2 []string) []string {
-	m := make(map[string]bool)
-	m2 := make(map[string]bool)
-	for _, v := range l2 {
-		m2[v] = true
+// selects addresses using the given protocol; an empty proto selects all addresses
+func whereProto(addresses []Address, proto string) []Address {
+	if proto == "" {
+		return addresses
 	}
-	for _, v := range l1 {
-		if m2[v] {
-			m[v] = true
+	selection := []Address{}
+	for _, address := range addresses {
+		if address.Proto == proto {
+			selection = append(selection, address)
 		}
 	}
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
-	}
-	return keys
+	return selection
 }
 
-func contains(input interface{}, key interface{}) bool {
-	if input == nil {
+// selects addresses not using the given protocol; an empty proto selects all addresses
+func whereNotProto(addresses []Address, proto string) []Address {
+	if proto == "" {
+		return addresses
+	}
+	selection := []Address{}
+	for _, address := range addresses {
+		if address.Proto != proto {
+			selection = append(selection, address)
+		}
+	}
+	return selection
+}
+
+// selects addresses using the given port, which may be a number or a string
+func whereAddressPort(addresses []Address, port interface{}) []Address {
+	p := fmt.Sprint(port)
+	selection := []Address{}
+	for _, address := range addresses {
+		if address.Port == p {
+			selection = append(selection, address)
+		}
+	}
+	return selection
+}
+
+// toContext converts an array or slice of RuntimeContainer or *RuntimeContainer,
+// such as the result of where, into a Context
+func toContext(funcName string, entries interface{}) (Context, error) {
+	switch containers := entries.(type) {
+	case nil:
+		return Context{}, nil
+	case Context:
+		return containers, nil
+	case []*RuntimeContainer:
+		return containers, nil
+	}
+
+	entriesVal, err := getArrayValues(funcName, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make(Context, 0, entriesVal.Len())
+	for i := 0; i < entriesVal.Len(); i++ {
+		switch v := entriesVal.Index(i).Interface().(type) {
+		case *RuntimeContainer:
+			containers = append(containers, v)
+		case RuntimeContainer:
+			containers = append(containers, &v)
+		default:
+			return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to '%v'; received %v", funcName, v)
+		}
+	}
+	return containers, nil
+}
+
+// toContainer converts a RuntimeContainer or *RuntimeContainer, such as an
+// element of the result of where or groupBy, into a *RuntimeContainer
+func toContainer(funcName string, entry interface{}) (*RuntimeContainer, error) {
+	switch container := entry.(type) {
+	case nil:
+		return nil, nil
+	case *RuntimeContainer:
+		return container, nil
+	case RuntimeContainer:
+		return &container, nil
+	}
+	return nil, fmt.Errorf("must pass a RuntimeContainer to '%v'; received %v", funcName, entry)
+}
+
+// generalized whereLabel function
+func generalizedWhereLabel(funcName string, entries interface{}, label string, test func(string, bool) bool) (Context, error) {
+	containers, err := toContext(funcName, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := make([]*RuntimeContainer, 0)
+
+	for i := 0; i < len(containers); i++ {
+		container := containers[i]
+
+		value, ok := container.Labels[label]
+		if test(value, ok) {
+			selection = append(selection, container)
+		}
+	}
+
+	return selection, nil
+}
+
+// selects containers that have a particular label
+func whereLabelExists(containers interface{}, label string) (Context, error) {
+	return generalizedWhereLabel("whereLabelExists", containers, label, func(_ string, ok bool) bool {
+		return ok
+	})
+}
+
+// selects containers that have don't have a particular label
+func whereLabelDoesNotExist(containers interface{}, label string) (Context, error) {
+	return generalizedWhereLabel("whereLabelDoesNotExist", containers, label, func(_ string, ok bool) bool {
+		return !ok
+	})
+}
+
+// lenientBool parses the usual spellings of a boolean toggle, ignoring case
+// and surrounding whitespace. ok is false for an empty or unrecognized value.
+func lenientBool(s string) (value bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, true
+	case "0", "f", "false", "n", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// generalizedWhereLabelBool selects containers whose label is the boolean
+// want. A missing or empty label counts as missing[0], or false by default;
+// any other value which is not a boolean is never selected.
+func generalizedWhereLabelBool(funcName string, containers interface{}, label string, want bool, missing []bool) (Context, error) {
+	if len(missing) > 1 {
+		return nil, fmt.Errorf("too many arguments passed to '%v'", funcName)
+	}
+	fallback := false
+	if len(missing) == 1 {
+		fallback = missing[0]
+	}
+	return generalizedWhereLabel(funcName, containers, label, func(v string, ok bool) bool {
+		if !ok || strings.TrimSpace(v) == "" {
+			return fallback == want
+		}
+		value, ok := lenientBool(v)
+		return ok && value == want
+	})
+}
+
+// selects containers with a particular label whose value is true, 1, yes or
+// on; missing labels are false unless otherwise specified
+func whereLabelTrue(containers interface{}, label string, missing ...bool) (Context, error) {
+	return generalizedWhereLabelBool("whereLabelTrue", containers, label, true, missing)
+}
+
+// selects containers with a particular label whose value is false, 0, no or
+// off; containers missing the label are selected unless missing is true
+func whereLabelFalse(containers interface{}, label string, missing ...bool) (Context, error) {
+	return generalizedWhereLabelBool("whereLabelFalse", containers, label, false, missing)
+}
+
+// selects containers with a particular label equal to a value
+func whereLabelValueEquals(containers interface{}, label, value string) (Context, error) {
+	return generalizedWhereLabel("whereLabelValueEquals", containers, label, func(v string, ok bool) bool {
+		return ok && v == value
+	})
+}
+
+// selects containers without a particular label equal to a value; containers
+// missing the label are selected
+func whereLabelValueNotEquals(containers interface{}, label, value string) (Context, error) {
+	return generalizedWhereLabel("whereLabelValueNotEquals", containers, label, func(v string, ok bool) bool {
+		return !ok || v != value
+	})
+}
+
+// selects containers with a particular label equal to the value of an
+// environment variable of the docker-gen process; when the variable is not
+// set, no container is selected
+func whereLabelEqualsEnv(containers interface{}, label, envVar string) (Context, error) {
+	expected, set := os.LookupEnv(envVar)
+	return generalizedWhereLabel("whereLabelEqualsEnv", containers, label, func(value string, ok bool) bool {
+		return set && ok && value == expected
+	})
+}
+
+// labelValueMatcher compiles a pattern passed to one of the whereLabelValueMatches
+// functions. An empty pattern is rejected as it would silently match every value,
+// and the catch-all ".*" skips the regular expression entirely.
+func labelValueMatcher(funcName, pattern string, fold bool) (func(string) bool, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern passed to '%v'; use whereLabelExists or whereEnvExists to select any value", funcName)
+	}
+	if pattern == ".*" {
+		return func(string) bool { return true }, nil
+	}
+
+	if fold {
+		pattern = "(?i)" + pattern
+	}
+	rx, err := compileRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return rx.MatchString, nil
+}
+
+// selects containers with a particular label whose value matches a regular expression
+func whereLabelValueMatches(containers interface{}, label, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereLabelValueMatches", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereLabel("whereLabelValueMatches", containers, label, func(value string, ok bool) bool {
+		return ok && match(value)
+	})
+}
+
+// selects containers without a particular label whose value matches a regular
+// expression; containers missing the label are selected
+func whereLabelValueNotMatches(containers interface{}, label, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereLabelValueNotMatches", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereLabel("whereLabelValueNotMatches", containers, label, func(value string, ok bool) bool {
+		return !ok || !match(value)
+	})
+}
+
+// selects containers with a particular label whose value matches a regular
+// expression, ignoring case
+func whereLabelValueMatchesFold(containers interface{}, label, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereLabelValueMatchesFold", pattern, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereLabel("whereLabelValueMatchesFold", containers, label, func(value string, ok bool) bool {
+		return ok && match(value)
+	})
+}
+
+// selects containers with a particular label whose value matches includePattern
+// but does not match excludePattern
+func whereLabelValueMatchesExcept(containers interface{}, label, includePattern, excludePattern string) (Context, error) {
+	include, err := labelValueMatcher("whereLabelValueMatchesExcept", includePattern, false)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := labelValueMatcher("whereLabelValueMatchesExcept", excludePattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereLabel("whereLabelValueMatchesExcept", containers, label, func(value string, ok bool) bool {
+		return ok && include(value) && !exclude(value)
+	})
+}
+
+// hostsForLabel returns the sorted, deduplicated hostnames in the comma
+// separated VIRTUAL_HOST environment variable of the containers with a
+// particular label whose value matches a regular expression
+func hostsForLabel(containers interface{}, label, pattern string) ([]string, error) {
+	selected, err := whereLabelValueMatches(containers, label, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	hosts := []string{}
+	for _, container := range selected {
+		for _, host := range strings.Split(container.Env["VIRTUAL_HOST"], ",") {
+			host = strings.TrimSpace(host)
+			if host == "" {
+				continue
+			}
+			if _, ok := seen[host]; !ok {
+				seen[host] = struct{}{}
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// selects containers whose label, or else environment variable, named key has
+// a value matching a regular expression
+func whereLabelOrEnvMatches(containers interface{}, key, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereLabelOrEnvMatches", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereContainer("whereLabelOrEnvMatches", containers, func(container *RuntimeContainer) bool {
+		if value, ok := container.Labels[key]; ok {
+			return match(value)
+		}
+		if value, ok := container.Env[key]; ok {
+			return match(value)
+		}
+		return false
+	})
+}
+
+// selects containers with a particular label whose value matches a shell glob,
+// e.g. web-*
+func whereLabelValueGlob(containers interface{}, label, glob string) (Context, error) {
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob passed to 'whereLabelValueGlob': %q", glob)
+	}
+
+	return generalizedWhereLabel("whereLabelValueGlob", containers, label, func(value string, ok bool) bool {
+		if !ok {
+			return false
+		}
+		matched, _ := path.Match(glob, value)
+		return matched
+	})
+}
+
+// selects containers that have at least one of the given labels; an empty
+// list of labels selects no containers
+func whereAnyLabelExists(containers interface{}, labels []string) (Context, error) {
+	return generalizedWhereContainer("whereAnyLabelExists", containers, func(container *RuntimeContainer) bool {
+		for _, label := range labels {
+			if _, ok := container.Labels[label]; ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// selects containers that have all of the given labels; an empty list of
+// labels selects every container
+func whereAllLabelsExist(containers interface{}, labels []string) (Context, error) {
+	return generalizedWhereContainer("whereAllLabelsExist", containers, func(container *RuntimeContainer) bool {
+		for _, label := range labels {
+			if _, ok := container.Labels[label]; !ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// selects containers having at least one label, whatever its key, whose value
+// matches a regular expression
+func whereAnyLabelValueMatches(containers interface{}, pattern string) (Context, error) {
+	match, err := labelValueMatcher("whereAnyLabelValueMatches", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereContainer("whereAnyLabelValueMatches", containers, func(container *RuntimeContainer) bool {
+		for _, value := range container.Labels {
+			if match(value) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// excludeLabels drops the containers that have at least one of the given labels
+func excludeLabels(containers interface{}, labels []string) (Context, error) {
+	return generalizedWhereContainer("excludeLabels", containers, func(container *RuntimeContainer) bool {
+		for _, label := range labels {
+			if _, ok := container.Labels[label]; ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+var shortIDPattern = regexp.MustCompile("^[0-9a-f]{12}$")
+
+// excludeSelf drops the container docker-gen is running in. When the current
+// container ID is unknown, the hostname is used if it looks like a short ID;
+// otherwise no container is dropped.
+func excludeSelf(containers interface{}) (Context, error) {
+	self := currentDocker().CurrentContainerID
+	if self == "" {
+		if hostname := os.Getenv("HOSTNAME"); shortIDPattern.MatchString(hostname) {
+			self = hostname
+		}
+	}
+
+	return generalizedWhereContainer("excludeSelf", containers, func(container *RuntimeContainer) bool {
+		return self == "" || !strings.HasPrefix(container.ID, self)
+	})
+}
+
+// activeContainers selects the containers currently serving: those running,
+// not reported unhealthy or still starting by their healthcheck, and with a
+// particular label whose value matches a regular expression. Containers
+// without a healthcheck are considered healthy.
+func activeContainers(containers interface{}, label, pattern string) (Context, error) {
+	match, err := labelValueMatcher("activeContainers", pattern, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereContainer("activeContainers", containers, func(container *RuntimeContainer) bool {
+		if !container.State.Running {
+			return false
+		}
+		if status := container.State.Health.Status; status != "" && status != "healthy" {
+			return false
+		}
+		value, ok := container.Labels[label]
+		return ok && match(value)
+	})
+}
+
+// generalized whereContainer function
+func generalizedWhereContainer(funcName string, entries interface{}, test func(*RuntimeContainer) bool) (Context, error) {
+	containers, err := toContext(funcName, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := make([]*RuntimeContainer, 0)
+
+	for i := 0; i < len(containers); i++ {
+		container := containers[i]
+
+		if test(container) {
+			selection = append(selection, container)
+		}
+	}
+
+	return selection, nil
+}
+
+// selects containers that have at least one address
+func whereAddressExists(containers interface{}) (Context, error) {
+	return generalizedWhereContainer("whereAddressExists", containers, func(container *RuntimeContainer) bool {
+		return len(container.Addresses) > 0
+	})
+}
+
+// selects containers with at least one address whose IP is within a CIDR
+func whereIPInCidr(containers interface{}, cidr string) (Context, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	return generalizedWhereContainer("whereIPInCidr", containers, func(container *RuntimeContainer) bool {
+		for _, address := range container.Addresses {
+			if ip := net.ParseIP(address.IP); ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// selects containers that have at least one published address
+func wherePublishedExists(containers interface{}) (Context, error) {
+	return generalizedWhereContainer("wherePublishedExists", containers, func(container *RuntimeContainer) bool {
+		return len(container.PublishedAddresses()) > 0
+	})
+}
+
+// envWithPrefix returns the environment variables of a container whose name
+// starts with prefix, keyed by the name with the prefix removed
+func envWithPrefix(entry interface{}, prefix string) (map[string]string, error) {
+	container, err := toContainer("envWithPrefix", entry)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string)
+	if container == nil {
+		return env, nil
+	}
+	for k, v := range container.Env {
+		if strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+			env[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return env, nil
+}
+
+// networks returns the names of the networks a container is attached to
+func networks(entry interface{}) ([]string, error) {
+	container, err := toContainer("networks", entry)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	if container == nil {
+		return names, nil
+	}
+	for _, network := range container.Networks {
+		names = append(names, network.Name)
+	}
+	return names, nil
+}
+
+// networkGateway returns the gateway of the named network of a container, or
+// an empty string when the container is not attached to it
+func networkGateway(entry interface{}, name string) (string, error) {
+	container, err := toContainer("networkGateway", entry)
+	if err != nil || container == nil {
+		return "", err
+	}
+	for _, network := range container.Networks {
+		if network.Name == name {
+			return network.Gateway, nil
+		}
+	}
+	return "", nil
+}
+
+// shortID returns the first 12 characters of the ID of a container
+func shortID(entry interface{}) (string, error) {
+	container, err := toContainer("shortID", entry)
+	if err != nil || container == nil {
+		return "", err
+	}
+	return container.ShortID(), nil
+}
+
+// publishedPortsInRange returns the published addresses of a container whose
+// host port is within [low, high]
+func publishedPortsInRange(entry interface{}, low, high int) ([]Address, error) {
+	container, err := toContainer("publishedPortsInRange", entry)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []Address{}
+	if container == nil {
+		return addresses, nil
+	}
+	for _, address := range container.PublishedAddresses() {
+		port, err := strconv.Atoi(address.HostPort)
+		if err == nil && port >= low && port <= high {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+// normalizePort returns the port number in s, e.g. a VIRTUAL_PORT value,
+// ignoring surrounding whitespace and a protocol suffix such as "/tcp"
+func normalizePort(s string) (int, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) == 2 && (parts[1] == "" || strings.Contains(parts[1], "/")) {
+		return 0, fmt.Errorf("invalid port %q passed to 'normalizePort'", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %q passed to 'normalizePort'", s)
+	}
+	return n, nil
+}
+
+// containsAny returns whether s contains at least one of the substrings
+func containsAny(substrings []string, s string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelValueExtract returns the first match of pattern in the value of a
+// container label, or its first capture group if the pattern has one. An empty
+// string is returned when the label is missing or does not match. An empty
+// pattern is rejected like in labelValueMatcher.
+func labelValueExtract(entry interface{}, label, pattern string) (string, error) {
+	if pattern == "" {
+		return "", errors.New("empty pattern passed to 'labelValueExtract'; use \".*\" to extract the whole value")
+	}
+	rx, err := compileRegexp(pattern)
+	if err != nil {
+		return "", err
+	}
+	container, err := toContainer("labelValueExtract", entry)
+	if err != nil || container == nil {
+		return "", err
+	}
+
+	value, ok := container.Labels[label]
+	if !ok {
+		return "", nil
+	}
+	match := rx.FindStringSubmatch(value)
+	if match == nil {
+		return "", nil
+	}
+	if len(match) > 1 {
+		return match[1], nil
+	}
+	return match[0], nil
+}
+
+// labelValueMatches returns whether the value of a container label matches a
+// regular expression. A missing label never matches.
+func labelValueMatches(entry interface{}, label, pattern string) (bool, error) {
+	match, err := labelValueMatcher("labelValueMatches", pattern, false)
+	if err != nil {
+		return false, err
+	}
+	container, err := toContainer("labelValueMatches", entry)
+	if err != nil || container == nil {
+		return false, err
+	}
+
+	value, ok := container.Labels[label]
+	return ok && match(value), nil
+}
+
+// labelFromList returns the value of the first of the given labels a container
+// has, or an empty string if it has none of them
+func labelFromList(entry interface{}, labels []string) (string, error) {
+	container, err := toContainer("labelFromList", entry)
+	if err != nil || container == nil {
+		return "", err
+	}
+	for _, label := range labels {
+		if value, ok := container.Labels[label]; ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// hasPrefix returns whether a given string is a prefix of another string
+func hasPrefix(prefix, s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// hasSuffix returns whether a given string is a suffix of another string
+func hasSuffix(suffix, s string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+// stringKeys returns the sorted keys of m
+func stringKeys(m map[string]string) []string {
+	k := make([]string, 0, len(m))
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
+
+func keys(input interface{}) (interface{}, error) {
+	if input == nil {
+		return nil, nil
+	}
+	// fast path for the common Env and Labels maps
+	if m, ok := input.(map[string]string); ok {
+		return stringKeys(m), nil
+	}
+
+	val := reflect.ValueOf(input)
+	if val.Kind() != reflect.Map {
+		return nil, fmt.Errorf("cannot call keys on a non-map value: %v", input)
+	}
+
+	return mapKeys(val), nil
+}
+
+// mapKeys returns the keys of the map val sorted by their string form, like items
+func mapKeys(val reflect.Value) []interface{} {
+	vk := val.MapKeys()
+	k := make([]interface{}, len(vk))
+	for i := range k {
+		k[i] = vk[i].Interface()
+	}
+	sort.SliceStable(k, func(i, j int) bool {
+		return fmt.Sprint(k[i]) < fmt.Sprint(k[j])
+	})
+	return k
+}
+
+// mapHasValue returns whether the map m has key with the given value. Values
+// which are not strings are compared by their default string format; a nil or
+// non-map m has no values.
+func mapHasValue(m interface{}, key, value string) bool {
+	val := reflect.ValueOf(m)
+	if val.Kind() != reflect.Map || val.Type().Key().Kind() != reflect.String {
+		return false
+	}
+
+	v := val.MapIndex(reflect.ValueOf(key).Convert(val.Type().Key()))
+	if !v.IsValid() {
+		return false
+	}
+	return fmt.Sprintf("%v", v.Interface()) == value
+}
+
+// mapInvert returns a map with the keys and values of m swapped. When several
+// keys have the same value, the last of them in sorted order wins.
+func mapInvert(m map[string]string) map[string]string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	inverted := make(map[string]string, len(m))
+	for _, k := range keys {
+		inverted[m[k]] = k
+	}
+	return inverted
+}
+
+// toMap returns a map from the string form of the value of key in each entry
+// to that entry. Entries without key are skipped, and the last of several
+// entries with the same value wins.
+func toMap(entries interface{}, key string) (map[string]interface{}, error) {
+	entriesVal, err := getArrayValues("toMap", entries)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{}, entriesVal.Len())
+	for i := 0; i < entriesVal.Len(); i++ {
+		v := reflect.Indirect(entriesVal.Index(i)).Interface()
+		if value := deepGet(v, key); value != nil {
+			m[fmt.Sprintf("%v", value)] = v
+		}
+	}
+	return m, nil
+}
+
+// MapItem is a single entry of a map as returned by items
+type MapItem struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// items returns the entries of a map sorted by the string form of their keys
+func items(input interface{}) ([]MapItem, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	val := reflect.ValueOf(input)
+	if val.Kind() != reflect.Map {
+		return nil, fmt.Errorf("cannot call items on a non-map value: %v", input)
+	}
+
+	entries := make([]MapItem, 0, val.Len())
+	iter := val.MapRange()
+	for iter.Next() {
+		entries = append(entries, MapItem{Key: iter.Key().Interface(), Value: iter.Value().Interface()})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return fmt.Sprint(entries[i].Key) < fmt.Sprint(entries[j].Key)
+	})
+	return entries, nil
+}
+
+func intersect(l1, l2 []string) []string {
+	m := make(map[string]bool)
+	m2 := make(map[string]bool)
+	for _, v := range l2 {
+		m2[v] = true
+	}
+	for _, v := range l1 {
+		if m2[v] {
+			m[v] = true
+		}
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func contains(input interface{}, key interface{}) bool {
+	if input == nil {
 		return false
 	}
 
@@ -361,6 +1581,71 @@ func hashSha1(input string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+var upstreamNameSeparators = regexp.MustCompile("[^a-z0-9]+")
+
+// upstreamName returns a stable identifier for parts, e.g. a virtual host and
+// a path: the lowercased parts with every run of characters other than
+// [a-z0-9] replaced by an underscore, followed by a short hash of the
+// original parts so that distinct parts do not collide
+func upstreamName(parts ...string) string {
+	name := upstreamNameSeparators.ReplaceAllString(strings.ToLower(strings.Join(parts, "_")), "_")
+	name = strings.Trim(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "upstream_" + name
+	}
+	return strings.TrimSuffix(name, "_") + "_" + hashSha1(strings.Join(parts, "\x00"))[:8]
+}
+
+// hashStruct returns the hexadecimal SHA-256 hash of the canonical JSON
+// representation of input, in which the keys of every object are sorted
+func hashStruct(input interface{}) (string, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	// round trip through a generic value so struct fields are sorted as well
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	if b, err = json.Marshal(v); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// hexEncode returns the hexadecimal encoding of the input string
+func hexEncode(input string) string {
+	return hex.EncodeToString([]byte(input))
+}
+
+// hexDecode returns the string represented by the hexadecimal input
+func hexDecode(input string) (string, error) {
+	b, err := hex.DecodeString(input)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// base32Encode returns the standard base32 encoding of the input string
+func base32Encode(input string) string {
+	return base32.StdEncoding.EncodeToString([]byte(input))
+}
+
+// base32Decode returns the string represented by the standard base32 input
+func base32Decode(input string) (string, error) {
+	b, err := base32.StdEncoding.DecodeString(input)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func marshalJson(input interface{}) (string, error) {
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
@@ -370,46 +1655,439 @@ func marshalJson(input interface{}) (string, error) {
 	return strings.TrimSuffix(buf.String(), "\n"), nil
 }
 
+// jsonEscape returns input escaped as the contents of a JSON string, without
+// the surrounding quotes. HTML characters are left as is.
+func jsonEscape(input string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// encoding a string cannot fail; invalid UTF-8 is replaced with U+FFFD
+	enc.Encode(input)
+	s := strings.TrimSuffix(buf.String(), "\n")
+	return s[1 : len(s)-1]
+}
+
+// jsonUnescape is the inverse of jsonEscape
+func jsonUnescape(input string) (string, error) {
+	var s string
+	if err := json.Unmarshal([]byte(`"`+input+`"`), &s); err != nil {
+		return "", fmt.Errorf("unable to unescape JSON string %q: %s", input, err)
+	}
+	return s, nil
+}
+
+// quoteJoin quotes every element of list as a JSON string and joins them with
+// sep. Elements that are not strings are formatted with fmt.Sprint first.
+func quoteJoin(sep string, list interface{}) (string, error) {
+	listVal, err := getArrayValues("quoteJoin", list)
+	if err != nil {
+		return "", err
+	}
+
+	quoted := make([]string, listVal.Len())
+	for i := 0; i < listVal.Len(); i++ {
+		quoted[i] = `"` + jsonEscape(fmt.Sprint(listVal.Index(i).Interface())) + `"`
+	}
+	return strings.Join(quoted, sep), nil
+}
+
+// mustUnmarshalJson is the same as unmarshalJson, but the error quotes the
+// offending input so malformed values can be tracked down
+func mustUnmarshalJson(input string) (interface{}, error) {
+	v, err := unmarshalJson(input)
+	if err != nil {
+		quoted := input
+		if len(quoted) > 64 {
+			quoted = quoted[:64] + "..."
+		}
+		return nil, fmt.Errorf("unable to parse JSON %q: %s", quoted, err)
+	}
+	return v, nil
+}
+
+// unmarshalJsonRequire is the same as unmarshalJson, but the input must be a
+// JSON object holding every one of the required top-level keys
+func unmarshalJsonRequire(input string, requiredKeys ...string) (interface{}, error) {
+	v, err := unmarshalJson(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(requiredKeys) == 0 {
+		return v, nil
+	}
+
+	object, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("JSON must be an object with the keys %v; received %v", requiredKeys, input)
+	}
+	missing := []string{}
+	for _, key := range requiredKeys {
+		if _, ok := object[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("JSON object is missing the keys %v", missing)
+	}
+	return v, nil
+}
+
+// toQueryString returns the URL-encoded query string of a map, such as one
+// built with dict, sorted by key, e.g. a=1&b=2
+func toQueryString(input interface{}) (string, error) {
+	entries, err := items(input)
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	for _, entry := range entries {
+		values.Set(fmt.Sprint(entry.Key), fmt.Sprint(entry.Value))
+	}
+	return values.Encode(), nil
+}
+
+// toProperties returns the Java properties representation of the map, one
+// key=value line per entry sorted by key
+func toProperties(input map[string]string) string {
+	keys := make([]string, 0, len(input))
+	for k := range input {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, k := range keys {
+		buf.WriteString(escapeProperty(k, true) + "=" + escapeProperty(input[k], false) + "\n")
+	}
+	return buf.String()
+}
+
+// escapeProperty escapes a key or value of a Java properties file
+func escapeProperty(s string, isKey bool) string {
+	var buf strings.Builder
+	for i, r := range s {
+		switch r {
+		case '\\', ':', '=':
+			buf.WriteString(`\` + string(r))
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case ' ':
+			// spaces separate keys from values and leading spaces of values are dropped
+			if isKey || i == 0 {
+				buf.WriteString(`\ `)
+			} else {
+				buf.WriteRune(r)
+			}
+		case '#', '!':
+			// would start a comment line
+			if isKey && i == 0 {
+				buf.WriteString(`\` + string(r))
+			} else {
+				buf.WriteRune(r)
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// toYamlBlock returns the YAML representation of input with every line
+// indented by indent spaces and a leading newline, ready to follow a YAML key
+func toYamlBlock(indent int, input interface{}) (string, error) {
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(input); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	pad := strings.Repeat(" ", indent)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = pad + line
+	}
+	return "\n" + strings.Join(lines, "\n"), nil
+}
+
 func unmarshalJson(input string) (interface{}, error) {
 	var v interface{}
 	if err := json.Unmarshal([]byte(input), &v); err != nil {
 		return nil, err
 	}
-	return v, nil
+	return v, nil
+}
+
+// marshalCsv returns the CSV representation of rows, quoting fields as needed
+func marshalCsv(rows [][]string) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(rows); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// unmarshalCsv parses input as CSV records
+func unmarshalCsv(input string) ([][]string, error) {
+	return csv.NewReader(strings.NewReader(input)).ReadAll()
+}
+
+// concat returns the elements of all the given arrays or slices in a single
+// slice. Nil arguments are skipped.
+func concat(lists ...interface{}) ([]interface{}, error) {
+	result := []interface{}{}
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		listVal, err := getArrayValues("concat", list)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < listVal.Len(); i++ {
+			result = append(result, listVal.Index(i).Interface())
+		}
+	}
+	return result, nil
+}
+
+// arrayFirst returns first item in the array or nil if the
+// input is nil or empty. For a map, the value of the first key
+// in the order of items is returned.
+func arrayFirst(input interface{}) interface{} {
+	if input == nil {
+		return nil
+	}
+
+	arr := reflect.ValueOf(input)
+
+	if arr.Len() == 0 {
+		return nil
+	}
+
+	if arr.Kind() == reflect.Map {
+		entries, _ := items(input)
+		return entries[0].Value
+	}
+
+	return arr.Index(0).Interface()
+}
+
+// arrayLast returns last item in the array. For a map, the value
+// of the last key in the order of items is returned, or nil if the
+// map is empty.
+func arrayLast(input interface{}) interface{} {
+	arr := reflect.ValueOf(input)
+
+	if arr.Kind() == reflect.Map {
+		entries, _ := items(input)
+		if len(entries) == 0 {
+			return nil
+		}
+		return entries[len(entries)-1].Value
+	}
+
+	return arr.Index(arr.Len() - 1).Interface()
+}
+
+// stablePick returns the element of list selected by the hash of seed. The
+// elements are ordered by their JSON representation first, so the same seed
+// picks the same element of a set regardless of its order. An empty list
+// returns nil.
+func stablePick(seed string, list interface{}) (interface{}, error) {
+	listVal, err := getArrayValues("stablePick", list)
+	if err != nil {
+		return nil, err
+	}
+	if listVal.Len() == 0 {
+		return nil, nil
+	}
+
+	type element struct {
+		key   string
+		value interface{}
+	}
+	elements := make([]element, listVal.Len())
+	for i := 0; i < listVal.Len(); i++ {
+		value := listVal.Index(i).Interface()
+		key, err := json.Marshal(reflect.Indirect(listVal.Index(i)).Interface())
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = element{key: string(key), value: value}
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		return elements[i].key < elements[j].key
+	})
+
+	h := fnv.New32a()
+	io.WriteString(h, seed)
+	return elements[h.Sum32()%uint32(len(elements))].value, nil
+}
+
+// arrayClosest find the longest matching substring in values
+// that matches input
+func arrayClosest(values []string, input string) string {
+	best := ""
+	for _, v := range values {
+		if strings.Contains(input, v) && len(v) > len(best) {
+			best = v
+		}
+	}
+	return best
+}
+
+// sortObjectsByKeys returns the entries of a generic array or slice sorted by the
+// string value of the path property key. Entries missing key sort first, as an
+// empty value, and entries with equal keys keep their original order.
+func sortObjectsByKeys(entries interface{}, key string) ([]interface{}, error) {
+	getKey := func(v interface{}) (interface{}, error) {
+		return deepGet(v, key), nil
+	}
+	return generalizedSort("sortObjectsByKeys", entries, getKey, false)
+}
+
+// sortObjectsByKeyNumeric returns the entries of a generic array or slice sorted by the path
+// property key, compared as numbers. Numeric values sort before non-numeric values, which
+// are compared as strings. Entries with equal keys keep their original order.
+func sortObjectsByKeyNumeric(entries interface{}, key string) ([]interface{}, error) {
+	getKey := func(v interface{}) (interface{}, error) {
+		return deepGet(v, key), nil
+	}
+	return generalizedSort("sortObjectsByKeyNumeric", entries, getKey, true)
+}
+
+// sortByKeys returns the entries of a generic array or slice sorted by the path
+// properties keys in priority order: entries with equal values of the first key
+// are ordered by the second, and so on. Values are compared as strings, missing
+// values sorting as empty.
+//
+// Passed a map, e.g. the result of groupBy, and no key, sortByKeys is the same
+// as items and returns its entries as Key/Value pairs sorted by key, except
+// that a nil map gives an empty slice.
+func sortByKeys(entries interface{}, keys ...string) (interface{}, error) {
+	if reflect.ValueOf(entries).Kind() == reflect.Map || entries == nil && len(keys) == 0 {
+		if len(keys) > 0 {
+			return nil, errors.New("keys cannot be passed to 'sortByKeys' with a map")
+		}
+		sorted, err := items(entries)
+		if sorted == nil && err == nil {
+			sorted = []MapItem{}
+		}
+		return sorted, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key must be passed to 'sortByKeys' with an array or slice")
+	}
+
+	var sorted interface{} = entries
+	// stable sorts from the least to the most significant key
+	for i := len(keys) - 1; i >= 0; i-- {
+		key := keys[i]
+		getKey := func(v interface{}) (interface{}, error) {
+			return deepGet(v, key), nil
+		}
+		result, err := generalizedSort("sortByKeys", sorted, getKey, false)
+		if err != nil {
+			return nil, err
+		}
+		sorted = result
+	}
+	return sorted, nil
+}
+
+// sortByLabel returns the containers sorted by the value of the given label.
+// Missing labels sort as empty values and containers with equal values keep
+// their original order.
+func sortByLabel(entries interface{}, label string) ([]interface{}, error) {
+	return generalizedSort("sortByLabel", entries, labelSortKey("sortByLabel", label), false)
+}
+
+// sortByLabelNumeric is the same as sortByLabel but the values are compared as
+// numbers, like sortObjectsByKeyNumeric
+func sortByLabelNumeric(entries interface{}, label string) ([]interface{}, error) {
+	return generalizedSort("sortByLabelNumeric", entries, labelSortKey("sortByLabelNumeric", label), true)
+}
+
+func labelSortKey(funcName, label string) func(interface{}) (interface{}, error) {
+	return func(v interface{}) (interface{}, error) {
+		if container, ok := v.(RuntimeContainer); ok {
+			if value, ok := container.Labels[label]; ok {
+				return value, nil
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("must pass an array or slice of RuntimeContainer to '%v'; received %v", funcName, v)
+	}
 }
 
-// arrayFirst returns first item in the array or nil if the
-// input is nil or empty
-func arrayFirst(input interface{}) interface{} {
-	if input == nil {
-		return nil
+// generalized sort function. The entries are stably sorted by the string form
+// of the value returned by getKey, a nil value sorting as empty. When numeric
+// is set, numeric values sort first and are compared as numbers.
+func generalizedSort(funcName string, entries interface{}, getKey func(interface{}) (interface{}, error), numeric bool) ([]interface{}, error) {
+	entriesVal, err := getArrayValues(funcName, entries)
+	if err != nil {
+		return nil, err
 	}
 
-	arr := reflect.ValueOf(input)
-
-	if arr.Len() == 0 {
-		return nil
+	type sortKey struct {
+		text    string
+		number  float64
+		numeric bool
 	}
 
-	return arr.Index(0).Interface()
-}
+	sorted := make([]interface{}, entriesVal.Len())
+	keys := make([]sortKey, entriesVal.Len())
+	for i := 0; i < entriesVal.Len(); i++ {
+		v := reflect.Indirect(entriesVal.Index(i)).Interface()
+		sorted[i] = v
 
-// arrayLast returns last item in the array
-func arrayLast(input interface{}) interface{} {
-	arr := reflect.ValueOf(input)
-	return arr.Index(arr.Len() - 1).Interface()
-}
+		value, err := getKey(v)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			keys[i].text = fmt.Sprint(value)
+			if !numeric {
+				continue
+			}
+			if n, err := strconv.ParseFloat(strings.TrimSpace(keys[i].text), 64); err == nil {
+				keys[i].number, keys[i].numeric = n, true
+			}
+		}
+	}
 
-// arrayClosest find the longest matching substring in values
-// that matches input
-func arrayClosest(values []string, input string) string {
-	best := ""
-	for _, v := range values {
-		if strings.Contains(input, v) && len(v) > len(best) {
-			best = v
+	indexes := make([]int, len(sorted))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := keys[indexes[i]], keys[indexes[j]]
+		if a.numeric != b.numeric {
+			return a.numeric
+		}
+		if a.numeric {
+			return a.number < b.number
 		}
+		return a.text < b.text
+	})
+
+	result := make([]interface{}, len(sorted))
+	for i, index := range indexes {
+		result[i] = sorted[index]
 	}
-	return best
+	return result, nil
 }
 
 // dirList returns a list of files in the specified path
@@ -436,6 +2114,65 @@ func coalesce(input ...interface{}) interface{} {
 	return nil
 }
 
+// replaceMap replaces every occurrence of each key of replacements in s with
+// its value. Replacements are applied sequentially in sorted key order, so a
+// later replacement also applies to the output of an earlier one.
+func replaceMap(replacements interface{}, s string) (string, error) {
+	val := reflect.ValueOf(replacements)
+	if val.Kind() != reflect.Map || val.Type().Key().Kind() != reflect.String {
+		return "", fmt.Errorf("must pass a map with string keys to 'replaceMap'; received %v", replacements)
+	}
+
+	olds := make([]string, 0, val.Len())
+	for _, k := range val.MapKeys() {
+		olds = append(olds, k.String())
+	}
+	sort.Strings(olds)
+
+	for _, old := range olds {
+		repl := val.MapIndex(reflect.ValueOf(old).Convert(val.Type().Key())).Interface()
+		s = strings.ReplaceAll(s, old, fmt.Sprint(repl))
+	}
+	return s, nil
+}
+
+// defaultIfEmpty returns fallback when list is nil or an empty array, slice,
+// map or string, and list otherwise
+func defaultIfEmpty(fallback, list interface{}) interface{} {
+	if list == nil {
+		return fallback
+	}
+
+	val := reflect.ValueOf(list)
+	switch val.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		if val.Len() == 0 {
+			return fallback
+		}
+	case reflect.Ptr:
+		if val.IsNil() {
+			return fallback
+		}
+		return defaultIfEmpty(fallback, val.Elem().Interface())
+	}
+	return list
+}
+
+// hasContainers returns true if containers is a non-empty array or slice; nil
+// and values of any other kind yield false instead of an error
+func hasContainers(containers interface{}) bool {
+	entries, err := getArrayValues("hasContainers", containers)
+	if err != nil {
+		return false
+	}
+	return entries.Len() > 0
+}
+
+// replaceFirst returns a string with the first occurrence of old replaced by new
+func replaceFirst(old, new, s string) string {
+	return strings.Replace(s, old, new, 1)
+}
+
 // trimPrefix returns a string without the prefix, if present
 func trimPrefix(prefix, s string) string {
 	return strings.TrimPrefix(s, prefix)
@@ -451,6 +2188,39 @@ func trim(s string) string {
 	return strings.TrimSpace(s)
 }
 
+// splitTrimN is the same as strings.SplitN but removes whitespace from both
+// sides of every substring
+func splitTrimN(s, sep string, n int) []string {
+	parts := strings.SplitN(s, sep, n)
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return parts
+}
+
+// trimQuotes removes a single pair of matching double or single quotes
+// surrounding a string
+func trimQuotes(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// trimTrailingSpace removes trailing spaces and tabs from every line of the
+// string, keeping both LF and CRLF line endings
+func trimTrailingSpace(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasSuffix(line, "\r") {
+			lines[i] = strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t") + "\r"
+		} else {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // toLower return the string in lower case
 func toLower(s string) string {
 	return strings.ToLower(s)
@@ -461,6 +2231,36 @@ func toUpper(s string) string {
 	return strings.ToUpper(s)
 }
 
+// humanizeBytes returns a human readable representation of n bytes using binary (IEC) units
+func humanizeBytes(n int64) string {
+	return humanizeUnits(n, 1024, []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"})
+}
+
+// humanizeBytesSI returns a human readable representation of n bytes using decimal (SI) units
+func humanizeBytesSI(n int64) string {
+	return humanizeUnits(n, 1000, []string{"kB", "MB", "GB", "TB", "PB", "EB"})
+}
+
+// humanizeUnits scales n by base until the value, rounded to one decimal, is
+// below base, so that 1048575 bytes is reported as 1.0 MiB rather than 1024.0 KiB
+func humanizeUnits(n int64, base int64, units []string) string {
+	if n < base && n > -base {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / float64(base)
+	unit := 0
+	for math.Abs(math.Round(value*10)/10) >= float64(base) && unit < len(units)-1 {
+		value /= float64(base)
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// formatDuration returns the canonical form of d, e.g. 1m30s
+func formatDuration(d time.Duration) string {
+	return d.String()
+}
+
 // when returns the trueValue when the condition is true and the falseValue otherwise
 func when(condition bool, trueValue, falseValue interface{}) interface{} {
 	if condition {
@@ -470,49 +2270,284 @@ func when(condition bool, trueValue, falseValue interface{}) interface{} {
 	}
 }
 
+// maxTplDepth limits how deeply tpl may render templates from within templates
+const maxTplDepth = 10
+
+// tpl returns a function that renders a string as a template with the given
+// data and the additional template functions funcs, e.g. those of configFuncs.
+// Nested calls are tracked through depth to guard against recursion.
+func tpl(depth int, funcs template.FuncMap) func(string, interface{}) (string, error) {
+	return func(text string, data interface{}) (string, error) {
+		if depth >= maxTplDepth {
+			return "", fmt.Errorf("tpl: maximum nesting depth of %d exceeded", maxTplDepth)
+		}
+
+		tmpl, err := newTemplate("tpl").Funcs(funcs).Funcs(template.FuncMap{"tpl": tpl(depth+1, funcs)}).Parse(text)
+		if err != nil {
+			return "", err
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
+
+// configFuncs returns the template functions depending on config
+func configFuncs(config Config) template.FuncMap {
+	funcs := template.FuncMap{
+		"isAllowedHost": allowedHosts(config.AllowedHostsFile),
+		"metadata":      metadata(config.MetadataDir),
+	}
+	funcs["tpl"] = tpl(0, funcs)
+	return funcs
+}
+
+type allowedHostsFile struct {
+	modTime time.Time
+	hosts   map[string]struct{}
+}
+
+// allowedHostsFiles caches the parsed allowed hosts files by path
+var allowedHostsFiles sync.Map
+
+// allowedHosts returns a function that reports whether a host is listed in
+// the file at path, one host per line. The file is read at most once per
+// generation, and parsed again only when its modification time changes. Any
+// host is allowed when path is empty, and none when the file cannot be read.
+func allowedHosts(path string) func(string) bool {
+	if path == "" {
+		return func(string) bool { return true }
+	}
+
+	var once sync.Once
+	var hosts map[string]struct{}
+	return func(host string) bool {
+		once.Do(func() {
+			hosts = loadAllowedHosts(path)
+		})
+		_, ok := hosts[strings.ToLower(strings.TrimSpace(host))]
+		return ok
+	}
+}
+
+func loadAllowedHosts(path string) map[string]struct{} {
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Unable to read allowed hosts: %s\n", err)
+		return nil
+	}
+	if cached, ok := allowedHostsFiles.Load(path); ok && cached.(allowedHostsFile).modTime.Equal(fi.ModTime()) {
+		return cached.(allowedHostsFile).hosts
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Unable to read allowed hosts: %s\n", err)
+		return nil
+	}
+	hosts := map[string]struct{}{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts[strings.ToLower(line)] = struct{}{}
+	}
+	allowedHostsFiles.Store(path, allowedHostsFile{modTime: fi.ModTime(), hosts: hosts})
+	return hosts
+}
+
+// metadata returns a function that returns the labels of a container
+// overlaid with the entries of <dir>/<container ID>.json. The container's own
+// labels are returned when the file is missing.
+func metadata(dir string) func(interface{}) (map[string]string, error) {
+	return func(entry interface{}) (map[string]string, error) {
+		container, err := toContainer("metadata", entry)
+		if err != nil {
+			return nil, err
+		}
+		labels := map[string]string{}
+		if container == nil {
+			return labels, nil
+		}
+		for k, v := range container.Labels {
+			labels[k] = v
+		}
+		if dir == "" {
+			return labels, nil
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, container.ID+".json"))
+		if os.IsNotExist(err) {
+			return labels, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		extra := map[string]string{}
+		if err := json.Unmarshal(data, &extra); err != nil {
+			return nil, fmt.Errorf("unable to parse metadata of container %s: %s", container.ID, err)
+		}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		return labels, nil
+	}
+}
+
 func newTemplate(name string) *template.Template {
 	tmpl := template.New(name).Funcs(template.FuncMap{
-		"exists":                 pathExists,
-		"toLower":                toLower,
-		"toUpper":                toUpper,
-		"closest":                   arrayClosest,
-		"coalesce":                  coalesce,
-		"contains":                  contains,
-		"dict":                      dict,
-		"dir":                       dirList,
-		"first":                     arrayFirst,
-		"groupBy":                   groupBy,
-		"groupByKeys":               groupByKeys,
-		"groupByMulti":              groupByMulti,
-		"groupByMultiKeyValuePairs": groupByMultiKeyValuePairs,
-		"groupByLabel":              groupByLabel,
-		"hasPrefix":                 hasPrefix,
-		"hasSuffix":                 hasSuffix,
-		"json":                      marshalJson,
-		"intersect":                 intersect,
-		"keys":                      keys,
-		"last":                      arrayLast,
-		"replace":                   strings.Replace,
-		"parseBool":                 strconv.ParseBool,
-		"parseJson":                 unmarshalJson,
-		"queryEscape":               url.QueryEscape,
-		"sha1":                      hashSha1,
-		"split":                     strings.Split,
-		"splitN":                    strings.SplitN,
-		"splitKeyValuePairs":        splitKeyValuePairs,
-		"trimPrefix":                trimPrefix,
-		"trimSuffix":                trimSuffix,
-		"trim":                      trim,
-		"when":                      when,
-		"where":                     where,
-		"whereNot":                  whereNot,
-		"whereExist":                whereExist,
-		"whereNotExist":             whereNotExist,
-		"whereAny":                  whereAny,
-		"whereAll":                  whereAll,
-		"whereLabelExists":          whereLabelExists,
-		"whereLabelDoesNotExist":    whereLabelDoesNotExist,
-		"whereLabelValueMatches":    whereLabelValueMatches,
+		"exists":                             pathExists,
+		"hexEncode":                          hexEncode,
+		"hexDecode":                          hexDecode,
+		"base32Encode":                       base32Encode,
+		"base32Decode":                       base32Decode,
+		"toCsv":                              marshalCsv,
+		"fromCsv":                            unmarshalCsv,
+		"toLower":                            toLower,
+		"toMap":                              toMap,
+		"toUpper":                            toUpper,
+		"closest":                            arrayClosest,
+		"coalesce":                           coalesce,
+		"base":                               filepath.Base,
+		"concat":                             concat,
+		"compileRegex":                       compileRegexp,
+		"defaultIfEmpty":                     defaultIfEmpty,
+		"contains":                           contains,
+		"countByLabel":                       countByLabel,
+		"countLabelValueMatches":             countLabelValueMatches,
+		"containsAny":                        containsAny,
+		"dict":                               dict,
+		"dir":                                dirList,
+		"dirname":                            filepath.Dir,
+		"duplicatePublishedPorts":            duplicatePublishedPorts,
+		"envWithPrefix":                      envWithPrefix,
+		"ext":                                filepath.Ext,
+		"networks":                           networks,
+		"networkGateway":                     networkGateway,
+		"normalizePort":                      normalizePort,
+		"shortID":                            shortID,
+		"publishedPortsInRange":              publishedPortsInRange,
+		"field":                              field,
+		"first":                              arrayFirst,
+		"formatDuration":                     formatDuration,
+		"groupBy":                            groupBy,
+		"groupByKeys":                        groupByKeys,
+		"groupByOrdered":                     groupByOrdered,
+		"groupByWithCount":                   groupByWithCount,
+		"groupByMulti":                       groupByMulti,
+		"groupByMultiKeyValuePairs":          groupByMultiKeyValuePairs,
+		"groupByMultiKeyValuePairsWithValue": groupByMultiKeyValuePairsWithValue,
+		"groupByLabel":                       groupByLabel,
+		"groupByLabelWithTransform":          groupByLabelWithTransform,
+		"groupByLabels":                      groupByLabels,
+		"groupByLabelMultiTrimmed":           groupByLabelMultiTrimmed,
+		"groupByLabelValueCapture":           groupByLabelValueCapture,
+		"groupByLabelValueCaptureSorted":     groupByLabelValueCaptureSorted,
+		"groupByLabelCaptureDict":            groupByLabelValueCapture,
+		"hashStruct":                         hashStruct,
+		"hasContainers":                      hasContainers,
+		"hasPrefix":                          hasPrefix,
+		"hasSuffix":                          hasSuffix,
+		"hostsForLabel":                      hostsForLabel,
+		"humanizeBytes":                      humanizeBytes,
+		"humanizeBytesSI":                    humanizeBytesSI,
+		"json":                               marshalJson,
+		"jsonEscape":                         jsonEscape,
+		"jsonUnescape":                       jsonUnescape,
+		"intersect":                          intersect,
+		"items":                              items,
+		"keys":                               keys,
+		"mapHasValue":                        mapHasValue,
+		"mapInvert":                          mapInvert,
+		"labelValueExtract":                  labelValueExtract,
+		"labelValueMatches":                  labelValueMatches,
+		"labelFromList":                      labelFromList,
+		"last":                               arrayLast,
+		"metadata":                           metadata(""),
+		"replace":                            strings.Replace,
+		"replaceFirst":                       replaceFirst,
+		"replaceMap":                         replaceMap,
+		"parseBool":                          strconv.ParseBool,
+		"parseDuration":                      time.ParseDuration,
+		"parseJson":                          unmarshalJson,
+		"parseKeyValuePairs":                 parseKeyValuePairs,
+		"mustParseJson":                      mustUnmarshalJson,
+		"parseJsonRequire":                   unmarshalJsonRequire,
+		"queryEscape":                        url.QueryEscape,
+		"quoteJoin":                          quoteJoin,
+		"toQueryString":                      toQueryString,
+		"regexMatchCompiled":                 regexMatchCompiled,
+		"regexFindAll":                       regexFindAll,
+		"sha1":                               hashSha1,
+		"sortObjectsByKeys":                  sortObjectsByKeys,
+		"sortObjectsByKeyNumeric":            sortObjectsByKeyNumeric,
+		"sortByLabel":                        sortByLabel,
+		"sortByLabelNumeric":                 sortByLabelNumeric,
+		"sortByKeys":                         sortByKeys,
+		"stablePick":                         stablePick,
+		"split":                              strings.Split,
+		"splitN":                             strings.SplitN,
+		"splitTrimN":                         splitTrimN,
+		"splitKeyValuePairs":                 splitKeyValuePairs,
+		"stringKeys":                         stringKeys,
+		"trimPrefix":                         trimPrefix,
+		"trimSuffix":                         trimSuffix,
+		"trim":                               trim,
+		"trimQuotes":                         trimQuotes,
+		"trimTrailingSpace":                  trimTrailingSpace,
+		"upstreamName":                       upstreamName,
+		"tpl":                                tpl(0, nil),
+		"toProperties":                       toProperties,
+		"toYamlBlock":                        toYamlBlock,
+		"when":                               when,
+		"where":                              where,
+		"whereNot":                           whereNot,
+		"whereExist":                         whereExist,
+		"whereNotExist":                      whereNotExist,
+		"whereSliceContains":                 whereSliceContains,
+		"whereEnv":                           whereEnv,
+		"whereEnvNot":                        whereEnvNot,
+		"whereEnvExists":                     whereEnvExists,
+		"whereEnvDoesNotExist":               whereEnvDoesNotExist,
+		"whereEnvValueMatches":               whereEnvValueMatches,
+		"whereEnvValueNotMatches":            whereEnvValueNotMatches,
+		"whereAny":                           whereAny,
+		"whereAll":                           whereAll,
+		"whereNumInRange":                    whereNumInRange,
+		"whereCompare":                       whereCompare,
+		"whereGreaterThan":                   whereGreaterThan,
+		"whereLessThan":                      whereLessThan,
+		"whereProto":                         whereProto,
+		"whereNotProto":                      whereNotProto,
+		"whereAddressPort":                   whereAddressPort,
+		"whereLabelExists":                   whereLabelExists,
+		"whereLabelDoesNotExist":             whereLabelDoesNotExist,
+		"whereLabelValueEquals":              whereLabelValueEquals,
+		"whereLabelValueNotEquals":           whereLabelValueNotEquals,
+		"whereLabelTrue":                     whereLabelTrue,
+		"whereLabelFalse":                    whereLabelFalse,
+		"whereLabelEqualsEnv":                whereLabelEqualsEnv,
+		"whereLabelValueMatches":             whereLabelValueMatches,
+		"whereLabelValueNotMatches":          whereLabelValueNotMatches,
+		"whereLabelValueMatchesFold":         whereLabelValueMatchesFold,
+		"whereLabelValueMatchesExcept":       whereLabelValueMatchesExcept,
+		"whereLabelOrEnvMatches":             whereLabelOrEnvMatches,
+		"whereLabelValueGlob":                whereLabelValueGlob,
+		"whereAnyLabelExists":                whereAnyLabelExists,
+		"whereAllLabelsExist":                whereAllLabelsExist,
+		"whereAnyLabelValueMatches":          whereAnyLabelValueMatches,
+		"excludeLabels":                      excludeLabels,
+		"excludeSelf":                        excludeSelf,
+		"activeContainers":                   activeContainers,
+		"exposed":                            whereAddressExists,
+		"published":                          wherePublishedExists,
+		"whereAddressExists":                 whereAddressExists,
+		"wherePublishedExists":               wherePublishedExists,
+		"whereIPInCidr":                      whereIPInCidr,
 	})
 	return tmpl
 }
@@ -531,8 +2566,63 @@ func filterRunning(config Config, containers Context) Context {
 	}
 }
 
+// filterNames keeps the containers whose name matches config.IncludeNameRegex
+// and then drops those whose name matches config.ExcludeNameRegex. An empty
+// pattern does not filter.
+func filterNames(config Config, containers Context) (Context, error) {
+	if config.IncludeNameRegex == "" && config.ExcludeNameRegex == "" {
+		return containers, nil
+	}
+
+	var include, exclude *regexp.Regexp
+	var err error
+	if config.IncludeNameRegex != "" {
+		if include, err = compileRegexp(config.IncludeNameRegex); err != nil {
+			return nil, fmt.Errorf("invalid include name pattern: %s", err)
+		}
+	}
+	if config.ExcludeNameRegex != "" {
+		if exclude, err = compileRegexp(config.ExcludeNameRegex); err != nil {
+			return nil, fmt.Errorf("invalid exclude name pattern: %s", err)
+		}
+	}
+
+	filteredContainers := Context{}
+	for _, container := range containers {
+		if include != nil && !include.MatchString(container.Name) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(container.Name) {
+			continue
+		}
+		filteredContainers = append(filteredContainers, container)
+	}
+	return filteredContainers, nil
+}
+
+// GenerateResult describes the outcome of a single template generation
+type GenerateResult struct {
+	Changed      bool
+	BytesWritten int
+	Dest         string
+	// Diff holds a unified diff of the old and new contents of Dest.
+	// It is only computed when Config.Diff or Config.EmitDiff is set.
+	Diff string
+	// Err is set when the template could not be rendered
+	Err error
+}
+
 func GenerateFile(config Config, containers Context) bool {
-	filteredRunningContainers := filterRunning(config, containers)
+	return GenerateFileResult(config, containers).Changed
+}
+
+// GenerateFileResult behaves like GenerateFile but reports what was written
+func GenerateFileResult(config Config, containers Context) GenerateResult {
+	filteredRunningContainers, err := filterNames(config, filterRunning(config, containers))
+	if err != nil {
+		log.Printf("Unable to filter containers: %s\n", err)
+		return GenerateResult{Dest: config.Dest, Err: err}
+	}
 	filteredContainers := Context{}
 	if config.OnlyPublished {
 		for _, container := range filteredRunningContainers {
@@ -550,7 +2640,19 @@ func GenerateFile(config Config, containers Context) bool {
 		filteredContainers = filteredRunningContainers
 	}
 
-	contents := executeTemplate(config.Template, filteredContainers)
+	if len(filteredContainers) < config.MinContainers {
+		log.Printf("Only %d containers matched, %d required. Leaving '%s' untouched", len(filteredContainers), config.MinContainers, config.Dest)
+		return GenerateResult{Dest: config.Dest}
+	}
+
+	contents, err := executeTemplate(config, filteredContainers)
+	if err != nil {
+		if _, timedOut := err.(timeoutError); !timedOut && !config.ContinueOnError {
+			log.Fatalf("Template error: %s\n", err)
+		}
+		log.Printf("Template error: %s. Leaving '%s' untouched\n", err, config.Dest)
+		return GenerateResult{Dest: config.Dest, Err: err}
+	}
 
 	if !config.KeepBlankLines {
 		buf := new(bytes.Buffer)
@@ -558,7 +2660,19 @@ func GenerateFile(config Config, containers Context) bool {
 		contents = buf.Bytes()
 	}
 
+	if config.TrimTrailingWhitespace {
+		contents = []byte(trimTrailingSpace(string(contents)))
+	}
+
+	if config.SkipIfEmpty && isBlank(string(contents)) {
+		log.Printf("Warning: template %s rendered empty contents. Leaving '%s' untouched", config.Template, config.Dest)
+		return GenerateResult{Dest: config.Dest}
+	}
+
 	if config.Dest != "" {
+		unlock := lockDest(config.Dest)
+		defer unlock()
+
 		dest, err := ioutil.TempFile(filepath.Dir(config.Dest), "docker-gen")
 		defer func() {
 			dest.Close()
@@ -583,10 +2697,11 @@ func GenerateFile(config Config, containers Context) bool {
 					fi, _ = os.Stat(config.Dest)
 				}
 			}
-			if err := dest.Chmod(fi.Mode()); err != nil {
+			mode, uid, gid := destOwnership(config, fi)
+			if err := dest.Chmod(mode); err != nil {
 				log.Fatalf("Unable to chmod temp file: %s\n", err)
 			}
-			if err := dest.Chown(int(fi.Sys().(*syscall.Stat_t).Uid), int(fi.Sys().(*syscall.Stat_t).Gid)); err != nil {
+			if err := dest.Chown(uid, gid); err != nil {
 				log.Fatalf("Unable to chown temp file: %s\n", err)
 			}
 			oldContents, err = ioutil.ReadFile(config.Dest)
@@ -595,31 +2710,345 @@ func GenerateFile(config Config, containers Context) bool {
 			}
 		}
 
-		if !bytes.Equal(oldContents, contents) {
+		result := GenerateResult{Dest: config.Dest}
+		if config.ForceWrite || !bytes.Equal(oldContents, contents) {
 			err = os.Rename(dest.Name(), config.Dest)
 			if err != nil {
 				log.Fatalf("Unable to create dest file %s: %s\n", config.Dest, err)
 			}
 			log.Printf("Generated '%s' from %d containers", config.Dest, len(filteredContainers))
-			return true
+			result.Changed = true
+			result.BytesWritten = len(contents)
+			if config.Diff || config.EmitDiff {
+				result.Diff = unifiedDiff(config.Dest, oldContents, contents)
+			}
+			if config.EmitDiff {
+				log.Printf("Changes to '%s':\n%s", config.Dest, result.Diff)
+			}
+		} else if config.FileMode != 0 || config.FileUID != nil || config.FileGID != nil {
+			// the destination is kept, but its mode and ownership must still
+			// be the configured ones
+			if fi, err := os.Stat(config.Dest); err == nil {
+				mode, uid, gid := destOwnership(config, fi)
+				if err := os.Chmod(config.Dest, mode); err != nil {
+					log.Printf("Unable to chmod %s: %s\n", config.Dest, err)
+				}
+				if err := os.Chown(config.Dest, uid, gid); err != nil {
+					log.Printf("Unable to chown %s: %s\n", config.Dest, err)
+				}
+			}
 		}
-		return false
+		writeSummary(config, result, len(filteredContainers), contents)
+		return result
 	} else {
-		os.Stdout.Write(contents)
+		n, _ := os.Stdout.Write(contents)
+		result := GenerateResult{Changed: true, BytesWritten: n}
+		writeSummary(config, result, len(filteredContainers), contents)
+		return result
+	}
+}
+
+// GenerateSummary is the record of a generation written to Config.SummaryDest
+type GenerateSummary struct {
+	Dest       string    `json:"dest"`
+	Containers int       `json:"containers"`
+	Hash       string    `json:"hash"`
+	Timestamp  time.Time `json:"timestamp"`
+	Changed    bool      `json:"changed"`
+}
+
+// writeSummary atomically writes the JSON summary of a generation to
+// config.SummaryDest, if set. Failures are logged but do not abort.
+func writeSummary(config Config, result GenerateResult, containers int, contents []byte) {
+	if config.SummaryDest == "" {
+		return
+	}
+
+	b, err := json.Marshal(GenerateSummary{
+		Dest:       result.Dest,
+		Containers: containers,
+		Hash:       fmt.Sprintf("%x", sha256.Sum256(contents)),
+		Timestamp:  time.Now().UTC(),
+		Changed:    result.Changed,
+	})
+	if err != nil {
+		log.Printf("Unable to encode summary: %s\n", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(config.SummaryDest), "docker-gen")
+	if err != nil {
+		log.Printf("Unable to create summary temp file: %s\n", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0644); err == nil {
+		_, err = tmp.Write(append(b, '\n'))
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), config.SummaryDest)
+	}
+	if err != nil {
+		log.Printf("Unable to write summary %s: %s\n", config.SummaryDest, err)
+	}
+}
+
+var destLocks sync.Map
+
+// destOwnership returns the mode, user and group of the destination file:
+// those of fi unless overridden by config
+func destOwnership(config Config, fi os.FileInfo) (os.FileMode, int, int) {
+	mode := fi.Mode()
+	uid, gid := int(fi.Sys().(*syscall.Stat_t).Uid), int(fi.Sys().(*syscall.Stat_t).Gid)
+	if config.FileMode != 0 {
+		mode = config.FileMode
+	}
+	if config.FileUID != nil {
+		uid = *config.FileUID
 	}
-	return true
+	if config.FileGID != nil {
+		gid = *config.FileGID
+	}
+	return mode, uid, gid
+}
+
+// lockDest serializes writes to the same destination file and returns the
+// function releasing the lock
+func lockDest(dest string) func() {
+	mu, _ := destLocks.LoadOrStore(filepath.Clean(dest), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
 }
 
-func executeTemplate(templatePath string, containers Context) []byte {
-	tmpl, err := newTemplate(filepath.Base(templatePath)).ParseFiles(templatePath)
+// abandonedRenders maps template paths to a channel closed once the rendering
+// abandoned by their last timeout returns
+var abandonedRenders sync.Map
+
+// executeTemplate renders the template of config. When config.Timeout is
+// non-zero and the execution takes longer, an error is returned and the
+// rendering goroutine is abandoned. It stops at its next write, but a template
+// looping without writing keeps running; until it returns, later executions of
+// the same template fail immediately so that at most one such rendering runs
+// per template.
+func executeTemplate(config Config, containers Context) ([]byte, error) {
+	templatePath, timeout := config.Template, time.Duration(config.Timeout)
+	tmpl, err := newTemplate(filepath.Base(templatePath)).Funcs(configFuncs(config)).ParseFiles(templatePath)
 	if err != nil {
 		log.Fatalf("Unable to parse template: %s", err)
 	}
 
-	buf := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(buf, filepath.Base(templatePath), &containers)
+	name := filepath.Base(templatePath)
+	if timeout <= 0 {
+		return renderTemplate(context.Background(), tmpl, name, &containers)
+	}
+	if finished, ok := abandonedRenders.Load(templatePath); ok {
+		select {
+		case <-finished.(<-chan struct{}):
+			abandonedRenders.Delete(templatePath)
+		default:
+			return nil, timeoutError{template: templatePath, timeout: timeout, running: true}
+		}
+	}
+	contents, finished, err := renderWithTimeout(tmpl, name, &containers, timeout)
+	if err == context.DeadlineExceeded {
+		abandonedRenders.Store(templatePath, finished)
+		return nil, timeoutError{template: templatePath, timeout: timeout}
+	}
+	return contents, err
+}
+
+// timeoutError reports a template execution exceeding Config.Timeout, or
+// skipped because a previous one still runs. Unlike other template errors, it
+// never ends the process.
+type timeoutError struct {
+	template string
+	timeout  time.Duration
+	running  bool
+}
+
+func (e timeoutError) Error() string {
+	if e.running {
+		return fmt.Sprintf("execution of %s skipped: a previous one is still running after timing out after %s", e.template, e.timeout)
+	}
+	return fmt.Sprintf("execution of %s timed out after %s", e.template, e.timeout)
+}
+
+// renderWithTimeout renders a template like renderTemplate, but returns
+// context.DeadlineExceeded as soon as timeout has passed. The rendering then
+// stops at its next write; finished is closed once it has returned.
+func renderWithTimeout(tmpl *template.Template, name string, data interface{}, timeout time.Duration) (contents []byte, finished <-chan struct{}, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type rendered struct {
+		contents []byte
+		err      error
+	}
+	done := make(chan rendered, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		contents, err := renderTemplate(ctx, tmpl, name, data)
+		done <- rendered{contents, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.contents, closed, r.err
+	case <-ctx.Done():
+		return nil, closed, ctx.Err()
+	}
+}
+
+// renderTemplate executes a template into a buffer which fails every write
+// once ctx is done, so that the execution stops
+func renderTemplate(ctx context.Context, tmpl *template.Template, name string, data interface{}) ([]byte, error) {
+	w := &contextWriter{ctx: ctx}
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// contextWriter is a bytes.Buffer whose writes fail once its context is done
+type contextWriter struct {
+	ctx context.Context
+	buf bytes.Buffer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+// patternArgs maps template functions taking a regular expression to the
+// positions of their pattern arguments
+var patternArgs = map[string][]int{
+	"compileRegex":                   {0},
+	"countLabelValueMatches":         {2},
+	"groupByLabelCaptureDict":        {2},
+	"groupByLabelValueCapture":       {2},
+	"groupByLabelValueCaptureSorted": {2},
+	"hostsForLabel":                  {2},
+	"labelValueExtract":              {2},
+	"labelValueMatches":              {2},
+	"regexFindAll":                   {0},
+	"whereAnyLabelValueMatches":      {1},
+	"whereEnvValueMatches":           {2},
+	"whereEnvValueNotMatches":        {2},
+	"whereLabelOrEnvMatches":         {2},
+	"whereLabelValueMatches":         {2},
+	"whereLabelValueMatchesExcept":   {2, 3},
+	"whereLabelValueMatchesFold":     {2},
+	"whereLabelValueNotMatches":      {2},
+}
+
+// ValidateTemplate parses the template of config, compiles the regular
+// expressions passed as literals to template functions and executes the
+// template against an empty Context, without writing any output. It does not
+// need a connection to Docker.
+func ValidateTemplate(config Config) error {
+	templatePath := config.Template
+	tmpl, err := newTemplate(filepath.Base(templatePath)).Funcs(configFuncs(config)).ParseFiles(templatePath)
 	if err != nil {
-		log.Fatalf("Template error: %s\n", err)
+		return err
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		if err := validatePatterns(t.Tree, t.Tree.Root); err != nil {
+			return err
+		}
+	}
+
+	containers := Context{}
+	return tmpl.ExecuteTemplate(ioutil.Discard, filepath.Base(templatePath), &containers)
+}
+
+// validatePatterns compiles the string literals passed as patterns to the
+// functions in patternArgs anywhere below node
+func validatePatterns(tree *parse.Tree, node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := validatePatterns(tree, child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return validatePatterns(tree, n.Pipe)
+	case *parse.IfNode:
+		return validateBranch(tree, &n.BranchNode)
+	case *parse.RangeNode:
+		return validateBranch(tree, &n.BranchNode)
+	case *parse.WithNode:
+		return validateBranch(tree, &n.BranchNode)
+	case *parse.TemplateNode:
+		return validatePatterns(tree, n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := validateCommand(tree, cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateBranch(tree *parse.Tree, branch *parse.BranchNode) error {
+	for _, node := range []parse.Node{branch.Pipe, branch.List, branch.ElseList} {
+		if err := validatePatterns(tree, node); err != nil {
+			return err
+		}
 	}
-	return buf.Bytes()
+	return nil
+}
+
+// validateCommand compiles the patterns of cmd. A piped value is passed as the
+// last argument, so the positions of the literal arguments are the same
+// whether cmd is piped or not.
+func validateCommand(tree *parse.Tree, cmd *parse.CommandNode) error {
+	for _, arg := range cmd.Args {
+		if err := validatePatterns(tree, arg); err != nil {
+			return err
+		}
+	}
+
+	if len(cmd.Args) == 0 {
+		return nil
+	}
+	ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		return nil
+	}
+	for _, pos := range patternArgs[ident.Ident] {
+		if pos+1 >= len(cmd.Args) {
+			continue
+		}
+		literal, ok := cmd.Args[pos+1].(*parse.StringNode)
+		if !ok {
+			continue
+		}
+		if _, err := compileRegexp(literal.Text); err != nil {
+			location, _ := tree.ErrorContext(literal)
+			return fmt.Errorf("%s: invalid pattern passed to '%s': %s", location, ident.Ident, err)
+		}
+	}
+	return nil
 }
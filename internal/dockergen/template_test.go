@@ -2,14 +2,21 @@ package dockergen
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -83,17 +90,78 @@ func TestContainsNilInput(t *testing.T) {
 	assert.False(t, contains(env, ""))
 }
 
+func TestContainsAny(t *testing.T) {
+	assert.True(t, containsAny([]string{"nginx", "caddy"}, "library/nginx:alpine"))
+	assert.True(t, containsAny([]string{"nginx", "caddy"}, "caddy"))
+	assert.False(t, containsAny([]string{"nginx", "caddy"}, "library/httpd"))
+	assert.False(t, containsAny([]string{}, "nginx"))
+
+	tests := templateTestList{
+		{`{{containsAny (split "nginx,caddy" ",") .}}`, "library/caddy:2", `true`},
+	}
+	tests.run(t, "containsAny")
+}
+
 func TestKeys(t *testing.T) {
 	env := map[string]string{
 		"VIRTUAL_HOST": "demo.local",
 	}
 	tests := templateTestList{
 		{`{{range (keys $)}}{{.}}{{end}}`, env, `VIRTUAL_HOST`},
+		{`{{range (keys $)}}{{.}} {{end}}`, map[string]int{"b": 2, "c": 3, "a": 1}, `a b c `},
+		{`{{range (keys $)}}{{.}} {{end}}`, map[int]bool{10: true, 2: false, 1: true}, `1 10 2 `},
 	}
 
 	tests.run(t, "keys")
 }
 
+func TestStringKeys(t *testing.T) {
+	labels := map[string]string{
+		"com.example.tier":    "frontend",
+		"com.example.enable":  "true",
+		"com.example.version": "1.2",
+	}
+	tests := templateTestList{
+		{`{{range (keys .)}}{{.}} {{end}}`, labels, `com.example.enable com.example.tier com.example.version `},
+		{`{{range (stringKeys .)}}{{.}} {{end}}`, labels, `com.example.enable com.example.tier com.example.version `},
+		{`{{len (stringKeys .)}}`, map[string]string{}, `0`},
+	}
+
+	tests.run(t, "stringKeys")
+
+	k, err := keys(labels)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"com.example.enable", "com.example.tier", "com.example.version"}, k)
+}
+
+func benchmarkLabels() map[string]string {
+	labels := map[string]string{}
+	for i := 0; i < 20; i++ {
+		labels[fmt.Sprintf("com.example.label%d", i)] = fmt.Sprint(i)
+	}
+	return labels
+}
+
+func BenchmarkKeysStringMap(b *testing.B) {
+	labels := benchmarkLabels()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := keys(labels); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeysReflect(b *testing.B) {
+	labels := reflect.ValueOf(benchmarkLabels())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mapKeys(labels)
+	}
+}
+
 func TestKeysEmpty(t *testing.T) {
 	input := map[string]int{}
 
@@ -122,6 +190,81 @@ func TestKeysNil(t *testing.T) {
 	}
 }
 
+func TestMapHasValue(t *testing.T) {
+	container := &RuntimeContainer{
+		Labels: map[string]string{
+			"com.example.enable": "true",
+			"com.example.empty":  "",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{mapHasValue .Labels "com.example.enable" "true"}}`, container, `true`},
+		{`{{mapHasValue .Labels "com.example.enable" "false"}}`, container, `false`},
+		{`{{mapHasValue .Labels "com.example.missing" "true"}}`, container, `false`},
+		{`{{mapHasValue .Labels "com.example.missing" ""}}`, container, `false`},
+		{`{{mapHasValue .Labels "com.example.empty" ""}}`, container, `true`},
+		{`{{mapHasValue .Env "VIRTUAL_HOST" ""}}`, container, `false`},
+	}
+
+	tests.run(t, "mapHasValue")
+
+	assert.False(t, mapHasValue(nil, "key", "value"))
+	assert.False(t, mapHasValue("not a map", "key", "value"))
+	assert.False(t, mapHasValue(map[int]string{1: "value"}, "1", "value"))
+	assert.True(t, mapHasValue(map[string]interface{}{"port": 80}, "port", "80"))
+}
+
+func TestMapInvert(t *testing.T) {
+	hosts := map[string]string{
+		"web": "web.localhost",
+		"api": "api.localhost",
+	}
+	assert.Equal(t, map[string]string{
+		"web.localhost": "web",
+		"api.localhost": "api",
+	}, mapInvert(hosts))
+
+	duplicates := map[string]string{
+		"web-blue":  "web.localhost",
+		"web-green": "web.localhost",
+		"api":       "api.localhost",
+	}
+	for i := 0; i < 10; i++ {
+		inverted := mapInvert(duplicates)
+		assert.Len(t, inverted, 2)
+		assert.Equal(t, "web-green", inverted["web.localhost"])
+	}
+
+	assert.Empty(t, mapInvert(nil))
+
+	tests := templateTestList{
+		{`{{index (mapInvert .) "web.localhost"}}`, hosts, `web`},
+	}
+	tests.run(t, "mapInvert")
+}
+
+func TestItems(t *testing.T) {
+	env := map[string]string{
+		"VIRTUAL_PORT": "80",
+		"VIRTUAL_HOST": "demo.local",
+		"A_FIRST":      "1",
+	}
+	tests := templateTestList{
+		{`{{range items .}}{{.Key}}={{.Value}};{{end}}`, env, `A_FIRST=1;VIRTUAL_HOST=demo.local;VIRTUAL_PORT=80;`},
+		{`{{range items .}}{{.Key}}{{end}}`, map[int]string{2: "b", 1: "a"}, `12`},
+	}
+
+	tests.run(t, "items")
+
+	entries, err := items(nil)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	_, err = items([]string{"foo"})
+	assert.Error(t, err)
+}
+
 func TestIntersect(t *testing.T) {
 	i := intersect([]string{"foo.fo.com", "bar.com"}, []string{"foo.bar.com"})
 	assert.Len(t, i, 0, "Expected no match")
@@ -201,6 +344,44 @@ func TestGroupByAfterWhere(t *testing.T) {
 	assert.Equal(t, "3", groups["demo2.localhost"][0].(RuntimeContainer).ID)
 }
 
+func TestGroupByNonStringKey(t *testing.T) {
+	type service struct {
+		Name    string
+		Port    int
+		Enabled bool
+	}
+	services := []service{
+		{Name: "web", Port: 80, Enabled: true},
+		{Name: "api", Port: 8080, Enabled: true},
+		{Name: "web-tls", Port: 80, Enabled: false},
+	}
+
+	groups, err := groupBy(services, "Port")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Len(t, groups["80"], 2)
+	assert.Equal(t, "api", groups["8080"][0].(service).Name)
+
+	groups, err = groupBy(services, "Enabled")
+	assert.NoError(t, err)
+	assert.Len(t, groups["true"], 2)
+	assert.Len(t, groups["false"], 1)
+
+	keys, err := groupByKeys(services, "Port")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"80", "8080"}, keys)
+
+	ordered, err := groupByOrdered(services, "Port")
+	assert.NoError(t, err)
+	assert.Len(t, ordered, 2)
+	assert.Equal(t, "80", ordered[0].Key)
+
+	tests := templateTestList{
+		{`{{range $port, $services := groupBy . "Port"}}{{$port}}:{{len $services}};{{end}}`, services, `80:2;8080:1;`},
+	}
+	tests.run(t, "groupByNonStringKey")
+}
+
 func TestGroupByKeys(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
@@ -234,6 +415,90 @@ func TestGroupByKeys(t *testing.T) {
 	assert.ElementsMatch(t, expected, groups)
 }
 
+func TestGroupByWithCount(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range $host, $group := groupByWithCount . "Env.VIRTUAL_HOST"}}{{$host}}:{{$group.Count}}:{{range $group.Containers}}{{.ID}}{{end}} {{end}}`, containers, `demo1.localhost:2:12 demo2.localhost:1:3 `},
+	}
+
+	tests.run(t, "groupByWithCount")
+
+	groups, err := groupByWithCount(containers, "Env.VIRTUAL_HOST")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	for _, group := range groups {
+		assert.Equal(t, len(group.Containers), group.Count)
+	}
+
+	_, err = groupByWithCount("not a slice", "Env.VIRTUAL_HOST")
+	assert.Error(t, err)
+}
+
+func TestGroupByOrdered(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	groups, err := groupByOrdered(containers, "Env.VIRTUAL_HOST")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, "demo2.localhost", groups[0].Key)
+	assert.Len(t, groups[0].Values, 2)
+	assert.Equal(t, "3", groups[0].Values[1].(RuntimeContainer).ID)
+	assert.Equal(t, "demo1.localhost", groups[1].Key)
+
+	tests := templateTestList{
+		{`{{range groupByOrdered . "Env.VIRTUAL_HOST"}}{{.Key}}:{{len .Values}} {{end}}`, containers, `demo2.localhost:2 demo1.localhost:1 `},
+	}
+	tests.run(t, "groupByOrdered")
+
+	_, err = groupByOrdered("foo", "Env.VIRTUAL_HOST")
+	assert.Error(t, err)
+}
+
 func TestGeneralizedGroupByError(t *testing.T) {
 	groups, err := groupBy("string", "")
 	assert.Error(t, err)
@@ -288,367 +553,318 @@ func TestGroupByLabelError(t *testing.T) {
 	assert.Nil(t, groups)
 }
 
-func TestGroupByMulti(t *testing.T) {
+func TestGroupByLabelWithTransform(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost",
+			Labels: map[string]string{
+				"com.example.env": "Production",
 			},
 			ID: "1",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost",
+			Labels: map[string]string{
+				"com.example.env": " production ",
 			},
 			ID: "2",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+			Labels: map[string]string{
+				"com.example.env": "staging",
 			},
 			ID: "3",
 		},
+		{
+			ID: "4",
+		},
 	}
 
-	groups, _ := groupByMulti(containers, "Env.VIRTUAL_HOST", ",")
-	if len(groups) != 3 {
-		t.Fatalf("expected 3 got %d", len(groups))
-	}
+	groups, err := groupByLabelWithTransform(containers, "com.example.env", "toLower")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	assert.Len(t, groups["production"], 1)
+	assert.Len(t, groups[" production "], 1)
 
-	if len(groups["demo1.localhost"]) != 2 {
-		t.Fatalf("expected 2 got %d", len(groups["demo1.localhost"]))
+	tests := templateTestList{
+		{`{{range $k, $v := groupByLabelWithTransform . "com.example.env" "trim"}}{{$k}}:{{len $v}};{{end}}`, containers, `Production:1;production:1;staging:1;`},
+		{`{{range $k, $v := groupByLabelWithTransform . "com.example.env" "toUpper"}}{{$k}}:{{len $v}};{{end}}`, containers, ` PRODUCTION :1;PRODUCTION:1;STAGING:1;`},
 	}
+	tests.run(t, "groupByLabelWithTransform")
 
-	if len(groups["demo2.localhost"]) != 1 {
-		t.Fatalf("expected 1 got %d", len(groups["demo2.localhost"]))
-	}
-	if groups["demo2.localhost"][0].(RuntimeContainer).ID != "3" {
-		t.Fatalf("expected 2 got %s", groups["demo2.localhost"][0].(RuntimeContainer).ID)
-	}
-	if len(groups["demo3.localhost"]) != 1 {
-		t.Fatalf("expect 1 got %d", len(groups["demo3.localhost"]))
-	}
-	if groups["demo3.localhost"][0].(RuntimeContainer).ID != "2" {
-		t.Fatalf("expected 2 got %s", groups["demo3.localhost"][0].(RuntimeContainer).ID)
-	}
+	_, err = groupByLabelWithTransform(containers, "com.example.env", "noSuchFunc")
+	assert.Error(t, err)
+	_, err = groupByLabelWithTransform([]string{"foo"}, "bar", "toLower")
+	assert.Error(t, err)
 }
 
-func TestGroupByMultiKeyValuePairs(t *testing.T) {
+func TestGroupByLabels(t *testing.T) {
 	containers := []*RuntimeContainer{
-		&RuntimeContainer{
-			Env: map[string]string{
-				"VIRTUAL_PORT": "443:3000,3000:3000",
+		{
+			Labels: map[string]string{
+				"com.docker.compose.project": "one",
+				"com.docker.compose.service": "web",
 			},
 			ID: "1",
 		},
-		&RuntimeContainer{
-			Env: map[string]string{
-				"VIRTUAL_PORT": "1111,250:360",
+		{
+			Labels: map[string]string{
+				"com.docker.compose.project": "one",
+				"com.docker.compose.service": "db",
 			},
 			ID: "2",
 		},
-		&RuntimeContainer{
-			Env: map[string]string{
-				"VIRTUAL_PORT": "123",
+		{
+			Labels: map[string]string{
+				"com.docker.compose.project": "one",
+				"com.docker.compose.service": "web",
 			},
 			ID: "3",
 		},
+		{
+			Labels: map[string]string{
+				"com.docker.compose.service": "web",
+			},
+			ID: "4",
+		},
 	}
 
-	groups, _ := groupByMultiKeyValuePairs(containers, "Env.VIRTUAL_PORT", ",", ":", "445")
-	if len(groups) != 4 {
-		t.Fatalf("expected 4 got %d", len(groups))
-	}
-
-	if len(groups["445"]) != 2 {
-		t.Fatalf("expected 2 got %d", len(groups["445"]))
-	}
-
-	if len(groups["443"]) != 1 {
-		t.Fatalf("expected 1 got %d", len(groups["443"]))
-	}
-	if groups["445"][1].(RuntimeContainer).ID != "3" {
-		t.Fatalf("expected 1 got %s", groups["445"][0].(RuntimeContainer).ID)
-	}
-	if len(groups["3000"]) != 1 {
-		t.Fatalf("expect 1 got %d", len(groups["3000"]))
-	}
-	if groups["250"][0].(RuntimeContainer).ID != "2" {
-		t.Fatalf("expected 1 got %s", groups["250"][0].(RuntimeContainer).ID)
-	}
-}
-
-func TestSplitKeyValuePairs1(t *testing.T) {
-	list := splitKeyValuePairs("key=value,1=2,test", ",", "=")
-
-	if len(list) != 3 {
-		t.Fatalf("expected 3 got %d", len(list))
-	}
-	if list["test"] != "test" {
-		t.Fatalf("expected value 'test' got '%s'", list["test"])
-	}
-}
+	groups, err := groupByLabels(containers, []string{"com.docker.compose.project", "com.docker.compose.service"}, "/")
 
-func TestSplitKeyValuePairs2(t *testing.T) {
-	list := splitKeyValuePairs("key:value/1:2/test", "/", ":")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	assert.Len(t, groups["one/web"], 2)
+	assert.Len(t, groups["one/db"], 1)
+	assert.Len(t, groups["/web"], 1)
+	assert.Equal(t, "4", groups["/web"][0].(RuntimeContainer).ID)
 
-	if len(list) != 3 {
-		t.Fatalf("expected 3 got %d", len(list))
-	}
-	if list["test"] != "test" {
-		t.Fatalf("expected value 'test' got '%s'", list["test"])
-	}
+	_, err = groupByLabels([]string{"foo"}, []string{"bar"}, "/")
+	assert.Error(t, err)
 }
 
-func TestWhere(t *testing.T) {
+func TestGroupByLabelMultiTrimmed(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost",
+			Labels: map[string]string{
+				"com.example.hosts": "foo.localhost, bar.localhost",
 			},
 			ID: "1",
-			Addresses: []Address{
-				{
-					IP:    "172.16.42.1",
-					Port:  "80",
-					Proto: "tcp",
-				},
-			},
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+			Labels: map[string]string{
+				"com.example.hosts": " bar.localhost,,baz.localhost , bar.localhost",
 			},
 			ID: "2",
-			Addresses: []Address{
-				{
-					IP:    "172.16.42.1",
-					Port:  "9999",
-					Proto: "tcp",
-				},
-			},
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo3.localhost",
+			Labels: map[string]string{
+				"com.example.hosts": " , ",
 			},
 			ID: "3",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
-			},
 			ID: "4",
 		},
 	}
 
-	tests := templateTestList{
-		{`{{where . "Env.VIRTUAL_HOST" "demo1.localhost" | len}}`, containers, `1`},
-		{`{{where . "Env.VIRTUAL_HOST" "demo2.localhost" | len}}`, containers, `2`},
-		{`{{where . "Env.VIRTUAL_HOST" "demo3.localhost" | len}}`, containers, `1`},
-		{`{{where . "Env.NOEXIST" "demo3.localhost" | len}}`, containers, `0`},
-		{`{{where .Addresses "Port" "80" | len}}`, containers[0], `1`},
-		{`{{where .Addresses "Port" "80" | len}}`, containers[1], `0`},
-		{
-			`{{where . "Value" 5 | len}}`,
-			[]struct {
-				Value int
-			}{
-				{Value: 5},
-				{Value: 3},
-				{Value: 5},
-			},
-			`2`,
-		},
-	}
+	groups, err := groupByLabelMultiTrimmed(containers, "com.example.hosts", ",")
 
-	tests.run(t, "where")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	assert.Len(t, groups["foo.localhost"], 1)
+	assert.Len(t, groups["bar.localhost"], 2)
+	assert.Len(t, groups["baz.localhost"], 1)
+	assert.Equal(t, "2", groups["baz.localhost"][0].(RuntimeContainer).ID)
+
+	_, err = groupByLabelMultiTrimmed([]string{"foo"}, "bar", ",")
+	assert.Error(t, err)
 }
 
-func TestWhereNot(t *testing.T) {
+func TestGroupByLabelValueCapture(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost",
+			Labels: map[string]string{
+				"com.example.router": "routers.foo.rule",
 			},
 			ID: "1",
-			Addresses: []Address{
-				{
-					IP:    "172.16.42.1",
-					Port:  "80",
-					Proto: "tcp",
-				},
-			},
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+			Labels: map[string]string{
+				"com.example.router": "routers.bar.rule",
 			},
 			ID: "2",
-			Addresses: []Address{
-				{
-					IP:    "172.16.42.1",
-					Port:  "9999",
-					Proto: "tcp",
-				},
-			},
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo3.localhost",
+			Labels: map[string]string{
+				"com.example.router": "routers.foo.rule",
 			},
 			ID: "3",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+			Labels: map[string]string{
+				"com.example.router": "services.baz",
 			},
 			ID: "4",
 		},
+		{
+			ID: "5",
+		},
 	}
 
+	groups, err := groupByLabelValueCapture(containers, "com.example.router", `^routers\.([^.]+)\.`)
+
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Len(t, groups["foo"], 2)
+	assert.Len(t, groups["bar"], 1)
+	assert.Equal(t, "2", groups["bar"][0].(RuntimeContainer).ID)
+
+	_, err = groupByLabelValueCapture(containers, "com.example.router", `^routers`)
+	assert.Error(t, err)
+
+	_, err = groupByLabelValueCapture(containers, "com.example.router", `(`)
+	assert.Error(t, err)
+
+	_, err = groupByLabelValueCapture([]string{"foo"}, "com.example.router", `(.*)`)
+	assert.Error(t, err)
+
 	tests := templateTestList{
-		{`{{whereNot . "Env.VIRTUAL_HOST" "demo1.localhost" | len}}`, containers, `3`},
-		{`{{whereNot . "Env.VIRTUAL_HOST" "demo2.localhost" | len}}`, containers, `2`},
-		{`{{whereNot . "Env.VIRTUAL_HOST" "demo3.localhost" | len}}`, containers, `3`},
-		{`{{whereNot . "Env.NOEXIST" "demo3.localhost" | len}}`, containers, `4`},
-		{`{{whereNot .Addresses "Port" "80" | len}}`, containers[0], `0`},
-		{`{{whereNot .Addresses "Port" "80" | len}}`, containers[1], `1`},
-		{
-			`{{whereNot . "Value" 5 | len}}`,
-			[]struct {
-				Value int
-			}{
-				{Value: 5},
-				{Value: 3},
-				{Value: 5},
-			},
-			`1`,
-		},
+		{`{{len (groupByLabelCaptureDict . "com.example.router" "^routers\\.([^.]+)\\.")}}`, containers, `2`},
 	}
 
-	tests.run(t, "whereNot")
+	tests.run(t, "groupByLabelCaptureDict")
 }
 
-func TestWhereExist(t *testing.T) {
+func TestCountLabelValueMatches(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost",
-				"VIRTUAL_PATH": "/api",
+			Labels: map[string]string{
+				"com.example.tier": "frontend",
 			},
 			ID: "1",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+			Labels: map[string]string{
+				"com.example.tier": "backend",
 			},
 			ID: "2",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo3.localhost",
-				"VIRTUAL_PATH": "/api",
+			Labels: map[string]string{
+				"com.example.tier": "frontend-canary",
 			},
 			ID: "3",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_PROTO": "https",
-			},
 			ID: "4",
 		},
 	}
 
 	tests := templateTestList{
-		{`{{whereExist . "Env.VIRTUAL_HOST" | len}}`, containers, `3`},
-		{`{{whereExist . "Env.VIRTUAL_PATH" | len}}`, containers, `2`},
-		{`{{whereExist . "Env.NOT_A_KEY" | len}}`, containers, `0`},
-		{`{{whereExist . "Env.VIRTUAL_PROTO" | len}}`, containers, `1`},
+		{`{{countLabelValueMatches . "com.example.tier" "^cache"}}`, containers, `0`},
+		{`{{countLabelValueMatches . "com.example.tier" "^back"}}`, containers, `1`},
+		{`{{countLabelValueMatches . "com.example.tier" "^front"}}`, containers, `2`},
+		{`{{countLabelValueMatches . "com.example.tier" ".*"}}`, containers, `3`},
+		{`{{if gt (countLabelValueMatches . "com.example.tier" "^front") 1}}many{{end}}`, containers, `many`},
+		{`{{countLabelValueMatches (where . "ID" "3") "com.example.tier" "^front"}}`, containers, `1`},
 	}
 
-	tests.run(t, "whereExist")
+	tests.run(t, "countLabelValueMatches")
+
+	_, err := countLabelValueMatches(containers, "com.example.tier", "(")
+	assert.Error(t, err)
+	_, err = countLabelValueMatches(containers, "com.example.tier", "")
+	assert.Error(t, err)
 }
 
-func TestWhereNotExist(t *testing.T) {
+func TestGroupByLabelValueCaptureSorted(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost",
-				"VIRTUAL_PATH": "/api",
+			Labels: map[string]string{
+				"com.example.router": "routers.web.rule",
 			},
 			ID: "1",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+			Labels: map[string]string{
+				"com.example.router": "routers.api.rule",
 			},
 			ID: "2",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo3.localhost",
-				"VIRTUAL_PATH": "/api",
+			Labels: map[string]string{
+				"com.example.router": "routers.web.rule",
 			},
 			ID: "3",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_PROTO": "https",
+			Labels: map[string]string{
+				"com.example.router": "routers.admin.rule",
 			},
 			ID: "4",
 		},
+		{
+			ID: "5",
+		},
 	}
 
+	groups, err := groupByLabelValueCaptureSorted(containers, "com.example.router", `^routers\.([^.]+)\.`)
+
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	assert.Equal(t, "admin", groups[0].Key)
+	assert.Equal(t, "api", groups[1].Key)
+	assert.Equal(t, "web", groups[2].Key)
+	assert.Len(t, groups[2].Values, 2)
+	assert.Equal(t, "1", groups[2].Values[0].(RuntimeContainer).ID)
+	assert.Equal(t, "3", groups[2].Values[1].(RuntimeContainer).ID)
+
 	tests := templateTestList{
-		{`{{whereNotExist . "Env.VIRTUAL_HOST" | len}}`, containers, `1`},
-		{`{{whereNotExist . "Env.VIRTUAL_PATH" | len}}`, containers, `2`},
-		{`{{whereNotExist . "Env.NOT_A_KEY" | len}}`, containers, `4`},
-		{`{{whereNotExist . "Env.VIRTUAL_PROTO" | len}}`, containers, `3`},
+		{`{{range groupByLabelValueCaptureSorted . "com.example.router" "^routers\\.([^.]+)\\."}}{{.Key}}:{{len .Values}};{{end}}`, containers, `admin:1;api:1;web:2;`},
 	}
+	tests.run(t, "groupByLabelValueCaptureSorted")
 
-	tests.run(t, "whereNotExist")
+	_, err = groupByLabelValueCaptureSorted(containers, "com.example.router", `^routers`)
+	assert.EqualError(t, err, "pattern passed to 'groupByLabelValueCaptureSorted' must have a capture group; received ^routers")
 }
 
-func TestWhereSomeMatch(t *testing.T) {
+func TestCountByLabel(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost",
+			Labels: map[string]string{
+				"com.docker.compose.project": "one",
 			},
 			ID: "1",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost,demo4.localhost",
+			Labels: map[string]string{
+				"com.docker.compose.project": "two",
 			},
 			ID: "2",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "bar,demo3.localhost,foo",
+			Labels: map[string]string{
+				"com.docker.compose.project": "one",
 			},
 			ID: "3",
 		},
 		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
-			},
 			ID: "4",
 		},
 	}
 
+	counts, err := countByLabel(containers, "com.docker.compose.project")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"one": 2, "two": 1}, counts)
+
 	tests := templateTestList{
-		{`{{whereAny . "Env.VIRTUAL_HOST" "," (split "demo1.localhost" ",") | len}}`, containers, `1`},
-		{`{{whereAny . "Env.VIRTUAL_HOST" "," (split "demo2.localhost,lala" ",") | len}}`, containers, `2`},
-		{`{{whereAny . "Env.VIRTUAL_HOST" "," (split "something,demo3.localhost" ",") | len}}`, containers, `1`},
-		{`{{whereAny . "Env.NOEXIST" "," (split "demo3.localhost" ",") | len}}`, containers, `0`},
+		{`{{index (countByLabel . "com.docker.compose.project") "one"}}`, containers, `2`},
 	}
+	tests.run(t, "countByLabel")
 
-	tests.run(t, "whereAny")
+	_, err = countByLabel([]string{"foo"}, "com.docker.compose.project")
+	assert.Error(t, err)
 }
 
-func TestWhereRequires(t *testing.T) {
+func TestGroupByMulti(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
 			Env: map[string]string{
@@ -658,377 +874,3779 @@ func TestWhereRequires(t *testing.T) {
 		},
 		{
 			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost,demo4.localhost",
+				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost",
 			},
 			ID: "2",
 		},
-		{
-			Env: map[string]string{
-				"VIRTUAL_HOST": "bar,demo3.localhost,foo",
-			},
-			ID: "3",
-		},
 		{
 			Env: map[string]string{
 				"VIRTUAL_HOST": "demo2.localhost",
 			},
-			ID: "4",
+			ID: "3",
 		},
 	}
 
-	tests := templateTestList{
-		{`{{whereAll . "Env.VIRTUAL_HOST" "," (split "demo1.localhost" ",") | len}}`, containers, `1`},
-		{`{{whereAll . "Env.VIRTUAL_HOST" "," (split "demo2.localhost,lala" ",") | len}}`, containers, `0`},
-		{`{{whereAll . "Env.VIRTUAL_HOST" "," (split "demo3.localhost" ",") | len}}`, containers, `1`},
-		{`{{whereAll . "Env.NOEXIST" "," (split "demo3.localhost" ",") | len}}`, containers, `0`},
+	groups, _ := groupByMulti(containers, "Env.VIRTUAL_HOST", ",")
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 got %d", len(groups))
 	}
 
-	tests.run(t, "whereAll")
+	if len(groups["demo1.localhost"]) != 2 {
+		t.Fatalf("expected 2 got %d", len(groups["demo1.localhost"]))
+	}
+
+	if len(groups["demo2.localhost"]) != 1 {
+		t.Fatalf("expected 1 got %d", len(groups["demo2.localhost"]))
+	}
+	if groups["demo2.localhost"][0].(RuntimeContainer).ID != "3" {
+		t.Fatalf("expected 2 got %s", groups["demo2.localhost"][0].(RuntimeContainer).ID)
+	}
+	if len(groups["demo3.localhost"]) != 1 {
+		t.Fatalf("expect 1 got %d", len(groups["demo3.localhost"]))
+	}
+	if groups["demo3.localhost"][0].(RuntimeContainer).ID != "2" {
+		t.Fatalf("expected 2 got %s", groups["demo3.localhost"][0].(RuntimeContainer).ID)
+	}
 }
 
-func TestWhereLabelExists(t *testing.T) {
+func TestGroupByMultiKeyValuePairs(t *testing.T) {
 	containers := []*RuntimeContainer{
-		{
-			Labels: map[string]string{
-				"com.example.foo": "foo",
-				"com.example.bar": "bar",
+		&RuntimeContainer{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "443:3000,3000:3000",
 			},
 			ID: "1",
 		},
-		{
-			Labels: map[string]string{
-				"com.example.bar": "bar",
+		&RuntimeContainer{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "1111,250:360",
 			},
 			ID: "2",
 		},
+		&RuntimeContainer{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "123",
+			},
+			ID: "3",
+		},
 	}
 
-	tests := templateTestList{
-		{`{{whereLabelExists . "com.example.foo" | len}}`, containers, `1`},
-		{`{{whereLabelExists . "com.example.bar" | len}}`, containers, `2`},
-		{`{{whereLabelExists . "com.example.baz" | len}}`, containers, `0`},
+	groups, _ := groupByMultiKeyValuePairs(containers, "Env.VIRTUAL_PORT", ",", ":", "445")
+	if len(groups) != 4 {
+		t.Fatalf("expected 4 got %d", len(groups))
 	}
 
-	tests.run(t, "whereLabelExists")
+	if len(groups["445"]) != 2 {
+		t.Fatalf("expected 2 got %d", len(groups["445"]))
+	}
+
+	if len(groups["443"]) != 1 {
+		t.Fatalf("expected 1 got %d", len(groups["443"]))
+	}
+	if groups["445"][1].(RuntimeContainer).ID != "3" {
+		t.Fatalf("expected 1 got %s", groups["445"][0].(RuntimeContainer).ID)
+	}
+	if len(groups["3000"]) != 1 {
+		t.Fatalf("expect 1 got %d", len(groups["3000"]))
+	}
+	if groups["250"][0].(RuntimeContainer).ID != "2" {
+		t.Fatalf("expected 1 got %s", groups["250"][0].(RuntimeContainer).ID)
+	}
 }
 
-func TestWhereLabelDoesNotExist(t *testing.T) {
+func TestGroupByMultiKeyValuePairsWithValue(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Labels: map[string]string{
-				"com.example.foo": "foo",
-				"com.example.bar": "bar",
+			Env: map[string]string{
+				"VIRTUAL_PORT": "443:3000,80:8080",
 			},
 			ID: "1",
 		},
 		{
-			Labels: map[string]string{
-				"com.example.bar": "bar",
+			Env: map[string]string{
+				"VIRTUAL_PORT": "443:4000",
 			},
 			ID: "2",
 		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "123",
+			},
+			ID: "3",
+		},
 	}
 
+	groups, err := groupByMultiKeyValuePairsWithValue(containers, "Env.VIRTUAL_PORT", ",", ":", "80")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Len(t, groups["443"], 2)
+	assert.Len(t, groups["80"], 2)
+
+	entry := groups["443"][1].(KeyValueEntry)
+	assert.Equal(t, "2", entry.Container.(RuntimeContainer).ID)
+	assert.Equal(t, "4000", entry.Value)
+
 	tests := templateTestList{
-		{`{{whereLabelDoesNotExist . "com.example.foo" | len}}`, containers, `1`},
-		{`{{whereLabelDoesNotExist . "com.example.bar" | len}}`, containers, `0`},
-		{`{{whereLabelDoesNotExist . "com.example.baz" | len}}`, containers, `2`},
+		{`{{range (index (groupByMultiKeyValuePairsWithValue . "Env.VIRTUAL_PORT" "," ":" "80") "80")}}{{.Container.ID}}:{{.Value}} {{end}}`, containers, `1:8080 3:123 `},
 	}
+	tests.run(t, "groupByMultiKeyValuePairsWithValue")
+}
 
-	tests.run(t, "whereLabelDoesNotExist")
+func TestSplitKeyValuePairs1(t *testing.T) {
+	list := splitKeyValuePairs("key=value,1=2,test", ",", "=")
+
+	if len(list) != 3 {
+		t.Fatalf("expected 3 got %d", len(list))
+	}
+	if list["test"] != "test" {
+		t.Fatalf("expected value 'test' got '%s'", list["test"])
+	}
 }
 
-func TestWhereLabelValueMatches(t *testing.T) {
+func TestSplitKeyValuePairs2(t *testing.T) {
+	list := splitKeyValuePairs("key:value/1:2/test", "/", ":")
+
+	if len(list) != 3 {
+		t.Fatalf("expected 3 got %d", len(list))
+	}
+	if list["test"] != "test" {
+		t.Fatalf("expected value 'test' got '%s'", list["test"])
+	}
+}
+
+func TestParseKeyValuePairs(t *testing.T) {
+	pairs := parseKeyValuePairs("X-Frame-Options=DENY,Set-Cookie=a=1,Set-Cookie=b=2,nosniff", ",", "=")
+	assert.Equal(t, []KeyValuePair{
+		{Key: "X-Frame-Options", Value: "DENY"},
+		{Key: "Set-Cookie", Value: "a=1"},
+		{Key: "Set-Cookie", Value: "b=2"},
+		{Key: "nosniff", Value: "nosniff"},
+	}, pairs)
+
+	tests := templateTestList{
+		{`{{range parseKeyValuePairs . ";" ":"}}{{.Key}}->{{.Value}} {{end}}`, "443:3000;80:8080;443:4000", `443->3000 80->8080 443->4000 `},
+	}
+	tests.run(t, "parseKeyValuePairs")
+}
+
+func TestWhere(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
-			Labels: map[string]string{
-				"com.example.foo": "foo",
-				"com.example.bar": "bar",
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
 			},
 			ID: "1",
+			Addresses: []Address{
+				{
+					IP:    "172.16.42.1",
+					Port:  "80",
+					Proto: "tcp",
+				},
+			},
 		},
 		{
-			Labels: map[string]string{
-				"com.example.bar": "BAR",
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
 			},
 			ID: "2",
+			Addresses: []Address{
+				{
+					IP:    "172.16.42.1",
+					Port:  "9999",
+					Proto: "tcp",
+				},
+			},
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo3.localhost",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "4",
 		},
 	}
 
 	tests := templateTestList{
-		{`{{whereLabelValueMatches . "com.example.foo" "^foo$" | len}}`, containers, `1`},
-		{`{{whereLabelValueMatches . "com.example.foo" "\\d+" | len}}`, containers, `0`},
-		{`{{whereLabelValueMatches . "com.example.bar" "^bar$" | len}}`, containers, `1`},
-		{`{{whereLabelValueMatches . "com.example.bar" "^(?i)bar$" | len}}`, containers, `2`},
-		{`{{whereLabelValueMatches . "com.example.bar" ".*" | len}}`, containers, `2`},
-		{`{{whereLabelValueMatches . "com.example.baz" ".*" | len}}`, containers, `0`},
+		{`{{where . "Env.VIRTUAL_HOST" "demo1.localhost" | len}}`, containers, `1`},
+		{`{{where . "Env.VIRTUAL_HOST" "demo2.localhost" | len}}`, containers, `2`},
+		{`{{where . "Env.VIRTUAL_HOST" "demo3.localhost" | len}}`, containers, `1`},
+		{`{{where . "Env.NOEXIST" "demo3.localhost" | len}}`, containers, `0`},
+		{`{{where .Addresses "Port" "80" | len}}`, containers[0], `1`},
+		{`{{where .Addresses "Port" "80" | len}}`, containers[1], `0`},
+		{
+			`{{where . "Value" 5 | len}}`,
+			[]struct {
+				Value int
+			}{
+				{Value: 5},
+				{Value: 3},
+				{Value: 5},
+			},
+			`2`,
+		},
 	}
 
-	tests.run(t, "whereLabelValueMatches")
-}
-
-func TestHasPrefix(t *testing.T) {
-	const prefix = "tcp://"
-	const str = "tcp://127.0.0.1:2375"
-	if !hasPrefix(prefix, str) {
-		t.Fatalf("expected %s to have prefix %s", str, prefix)
-	}
+	tests.run(t, "where")
 }
 
-func TestHasSuffix(t *testing.T) {
-	const suffix = ".local"
-	const str = "myhost.local"
-	if !hasSuffix(suffix, str) {
-		t.Fatalf("expected %s to have suffix %s", str, suffix)
+func TestField(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Name: "backend",
+			ID:   "1",
+		},
+		{
+			Env: map[string]string{
+				"LINK": "backend",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"LINK": "other",
+			},
+			ID: "3",
+		},
 	}
-}
 
-func TestSplitN(t *testing.T) {
 	tests := templateTestList{
-		{`{{index (splitN . "/" 2) 0}}`, "example.com/path", `example.com`},
-		{`{{index (splitN . "/" 2) 1}}`, "example.com/path", `path`},
-		{`{{index (splitN . "/" 2) 1}}`, "example.com/a/longer/path", `a/longer/path`},
-		{`{{len (splitN . "/" 2)}}`, "example.com", `1`},
-	}
-
-	tests.run(t, "splitN")
-}
-
-func TestTrimPrefix(t *testing.T) {
-	const prefix = "tcp://"
-	const str = "tcp://127.0.0.1:2375"
-	const trimmed = "127.0.0.1:2375"
-	got := trimPrefix(prefix, str)
-	if got != trimmed {
-		t.Fatalf("expected trimPrefix(%s,%s) to be %s, got %s", prefix, str, trimmed, got)
-	}
-}
-
-func TestTrimSuffix(t *testing.T) {
-	const suffix = ".local"
-	const str = "myhost.local"
-	const trimmed = "myhost"
-	got := trimSuffix(suffix, str)
-	if got != trimmed {
-		t.Fatalf("expected trimSuffix(%s,%s) to be %s, got %s", suffix, str, trimmed, got)
-	}
-}
-
-func TestTrim(t *testing.T) {
-	const str = "  myhost.local  "
-	const trimmed = "myhost.local"
-	got := trim(str)
-	if got != trimmed {
-		t.Fatalf("expected trim(%s) to be %s, got %s", str, trimmed, got)
+		{`{{field (index . 0) "Name"}}`, containers, `backend`},
+		{`{{field (index . 1) "Env.LINK"}}`, containers, `backend`},
+		{`{{field (index . 0) "Env.LINK"}}`, containers, `<no value>`},
+		{`{{range where . "Env.LINK" (field (index . 0) "Name")}}{{.ID}}{{end}}`, containers, `2`},
 	}
-}
 
-func TestToLower(t *testing.T) {
-	const str = ".RaNd0m StrinG_"
-	const lowered = ".rand0m string_"
-	assert.Equal(t, lowered, toLower(str), "Unexpected value from toLower()")
-}
+	tests.run(t, "field")
 
-func TestToUpper(t *testing.T) {
-	const str = ".RaNd0m StrinG_"
-	const uppered = ".RAND0M STRING_"
-	assert.Equal(t, uppered, toUpper(str), "Unexpected value from toUpper()")
+	var container *RuntimeContainer
+	assert.Nil(t, field(container, "Name"))
+	assert.Nil(t, field(nil, "Name"))
 }
 
-func TestDict(t *testing.T) {
+func TestWhereNot(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
 			Env: map[string]string{
 				"VIRTUAL_HOST": "demo1.localhost",
 			},
 			ID: "1",
+			Addresses: []Address{
+				{
+					IP:    "172.16.42.1",
+					Port:  "80",
+					Proto: "tcp",
+				},
+			},
 		},
 		{
 			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost",
+				"VIRTUAL_HOST": "demo2.localhost",
 			},
 			ID: "2",
+			Addresses: []Address{
+				{
+					IP:    "172.16.42.1",
+					Port:  "9999",
+					Proto: "tcp",
+				},
+			},
 		},
 		{
 			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+				"VIRTUAL_HOST": "demo3.localhost",
 			},
 			ID: "3",
 		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "4",
+		},
 	}
-	d, err := dict("/", containers)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if d["/"] == nil {
-		t.Fatalf("did not find containers in dict: %s", d)
-	}
-	if d["MISSING"] != nil {
-		t.Fail()
-	}
-}
 
-func TestSha1(t *testing.T) {
-	sum := hashSha1("/path")
-	if sum != "4f26609ad3f5185faaa9edf1e93aa131e2131352" {
-		t.Fatal("Incorrect SHA1 sum")
+	tests := templateTestList{
+		{`{{whereNot . "Env.VIRTUAL_HOST" "demo1.localhost" | len}}`, containers, `3`},
+		{`{{whereNot . "Env.VIRTUAL_HOST" "demo2.localhost" | len}}`, containers, `2`},
+		{`{{whereNot . "Env.VIRTUAL_HOST" "demo3.localhost" | len}}`, containers, `3`},
+		{`{{whereNot . "Env.NOEXIST" "demo3.localhost" | len}}`, containers, `4`},
+		{`{{whereNot .Addresses "Port" "80" | len}}`, containers[0], `0`},
+		{`{{whereNot .Addresses "Port" "80" | len}}`, containers[1], `1`},
+		{
+			`{{whereNot . "Value" 5 | len}}`,
+			[]struct {
+				Value int
+			}{
+				{Value: 5},
+				{Value: 3},
+				{Value: 5},
+			},
+			`1`,
+		},
 	}
+
+	tests.run(t, "whereNot")
 }
 
-func TestJson(t *testing.T) {
+func TestWhereExist(t *testing.T) {
 	containers := []*RuntimeContainer{
 		{
 			Env: map[string]string{
 				"VIRTUAL_HOST": "demo1.localhost",
+				"VIRTUAL_PATH": "/api",
 			},
 			ID: "1",
 		},
 		{
 			Env: map[string]string{
-				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost",
+				"VIRTUAL_HOST": "demo2.localhost",
 			},
 			ID: "2",
 		},
 		{
 			Env: map[string]string{
-				"VIRTUAL_HOST": "demo2.localhost",
+				"VIRTUAL_HOST": "demo3.localhost",
+				"VIRTUAL_PATH": "/api",
 			},
 			ID: "3",
 		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_PROTO": "https",
+			},
+			ID: "4",
+		},
 	}
-	output, err := marshalJson(containers)
-	if err != nil {
-		t.Fatal(err)
+
+	tests := templateTestList{
+		{`{{whereExist . "Env.VIRTUAL_HOST" | len}}`, containers, `3`},
+		{`{{whereExist . "Env.VIRTUAL_PATH" | len}}`, containers, `2`},
+		{`{{whereExist . "Env.NOT_A_KEY" | len}}`, containers, `0`},
+		{`{{whereExist . "Env.VIRTUAL_PROTO" | len}}`, containers, `1`},
+	}
+
+	tests.run(t, "whereExist")
+}
+
+func TestWhereNotExist(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+				"VIRTUAL_PATH": "/api",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo3.localhost",
+				"VIRTUAL_PATH": "/api",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_PROTO": "https",
+			},
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereNotExist . "Env.VIRTUAL_HOST" | len}}`, containers, `1`},
+		{`{{whereNotExist . "Env.VIRTUAL_PATH" | len}}`, containers, `2`},
+		{`{{whereNotExist . "Env.NOT_A_KEY" | len}}`, containers, `4`},
+		{`{{whereNotExist . "Env.VIRTUAL_PROTO" | len}}`, containers, `3`},
+	}
+
+	tests.run(t, "whereNotExist")
+}
+
+func TestWhereSliceContains(t *testing.T) {
+	web := Address{IP: "172.16.42.1", Port: "80", Proto: "tcp"}
+	tls := Address{IP: "172.16.42.1", Port: "443", Proto: "tcp"}
+	containers := []*RuntimeContainer{
+		{
+			Addresses: []Address{web, tls},
+			ID:        "1",
+		},
+		{
+			Addresses: []Address{web},
+			ID:        "2",
+		},
+		{
+			Addresses: []Address{{IP: "172.16.42.2", Port: "80", Proto: "tcp"}},
+			ID:        "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{$web := index (index . 1).Addresses 0}}{{range whereSliceContains . "Addresses" $web}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{$tls := index (index . 0).Addresses 1}}{{range whereSliceContains . "Addresses" $tls}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{whereSliceContains . "Addresses" "80" | len}}`, containers, `0`},
+		{`{{whereSliceContains . "ID" "1" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereSliceContains")
+
+	selected, err := whereSliceContains(containers, "Addresses", Address{IP: "172.16.42.2", Port: "80", Proto: "tcp"})
+	assert.NoError(t, err)
+	assert.Len(t, selected, 1)
+	assert.Equal(t, "3", selected.([]interface{})[0].(RuntimeContainer).ID)
+}
+
+func TestWhereEnv(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereEnv . "VIRTUAL_HOST" "demo1.localhost"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereEnv . "VIRTUAL_HOST" ""}}{{.ID}}{{end}}`, containers, `3`},
+		{`{{whereEnv . "NOEXIST" "" | len}}`, containers, `0`},
+		{`{{range whereEnvNot . "VIRTUAL_HOST" "demo1.localhost"}}{{.ID}}{{end}}`, containers, `234`},
+		{`{{whereEnvNot . "NOEXIST" "" | len}}`, containers, `4`},
+		{`{{range whereEnvExists . "VIRTUAL_HOST"}}{{.ID}}{{end}}`, containers, `123`},
+		{`{{range whereEnvDoesNotExist . "VIRTUAL_HOST"}}{{.ID}}{{end}}`, containers, `4`},
+		{`{{range whereEnv (where . "ID" "2") "VIRTUAL_HOST" "demo2.localhost"}}{{.ID}}{{end}}`, containers, `2`},
+	}
+
+	tests.run(t, "whereEnv")
+}
+
+func TestWhereEnvValueMatches(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.example.com",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.example.org",
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereEnvValueMatches . "VIRTUAL_HOST" "\\.example\\.com$"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{whereEnvValueMatches . "VIRTUAL_HOST" "^demo" | len}}`, containers, `2`},
+		{`{{whereEnvValueMatches . "VIRTUAL_HOST" ".*" | len}}`, containers, `2`},
+		{`{{whereEnvValueMatches . "MISSING" ".*" | len}}`, containers, `0`},
+		{`{{range whereEnvValueNotMatches . "VIRTUAL_HOST" "\\.example\\.com$"}}{{.ID}}{{end}}`, containers, `23`},
+		{`{{whereEnvValueNotMatches . "MISSING" ".*" | len}}`, containers, `3`},
+	}
+
+	tests.run(t, "whereEnvValueMatches")
+
+	_, err := whereEnvValueMatches(containers, "VIRTUAL_HOST", "(")
+	assert.Error(t, err)
+	_, err = whereEnvValueNotMatches(containers, "VIRTUAL_HOST", "(")
+	assert.Error(t, err)
+
+	// like the label filters, an empty pattern is an error and containers are returned
+	_, err = whereEnvValueMatches(containers, "VIRTUAL_HOST", "")
+	assert.Error(t, err)
+	_, err = whereEnvValueNotMatches(containers, "VIRTUAL_HOST", "")
+	assert.Error(t, err)
+	selected, err := whereEnvValueMatches(containers, "VIRTUAL_HOST", "^demo1")
+	assert.NoError(t, err)
+	assert.Equal(t, Context{containers[0]}, selected)
+}
+
+func TestWhereSomeMatch(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost,demo4.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "bar,demo3.localhost,foo",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereAny . "Env.VIRTUAL_HOST" "," (split "demo1.localhost" ",") | len}}`, containers, `1`},
+		{`{{whereAny . "Env.VIRTUAL_HOST" "," (split "demo2.localhost,lala" ",") | len}}`, containers, `2`},
+		{`{{whereAny . "Env.VIRTUAL_HOST" "," (split "something,demo3.localhost" ",") | len}}`, containers, `1`},
+		{`{{whereAny . "Env.NOEXIST" "," (split "demo3.localhost" ",") | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereAny")
+}
+
+func TestWhereRequires(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost,demo4.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "bar,demo3.localhost,foo",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereAll . "Env.VIRTUAL_HOST" "," (split "demo1.localhost" ",") | len}}`, containers, `1`},
+		{`{{whereAll . "Env.VIRTUAL_HOST" "," (split "demo2.localhost,lala" ",") | len}}`, containers, `0`},
+		{`{{whereAll . "Env.VIRTUAL_HOST" "," (split "demo3.localhost" ",") | len}}`, containers, `1`},
+		{`{{whereAll . "Env.NOEXIST" "," (split "demo3.localhost" ",") | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereAll")
+}
+
+func TestDuplicatePublishedPorts(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Addresses: []Address{
+				{Port: "80", HostPort: "8080", HostIP: "0.0.0.0", Proto: "tcp"},
+				{Port: "80", HostPort: "8080", HostIP: "0.0.0.0", Proto: "udp"},
+				{Port: "443", HostPort: "8443", HostIP: "0.0.0.0", Proto: "tcp"},
+			},
+			ID: "1",
+		},
+		{
+			Addresses: []Address{
+				{Port: "8000", HostPort: "8080", HostIP: "0.0.0.0", Proto: "tcp"},
+			},
+			ID: "2",
+		},
+		{
+			Addresses: []Address{
+				{Port: "80", HostPort: "8080", HostIP: "127.0.0.1", Proto: "tcp"},
+				{Port: "443", Proto: "tcp"},
+			},
+			ID: "3",
+		},
+	}
+
+	duplicates, err := duplicatePublishedPorts(containers)
+	assert.NoError(t, err)
+	assert.Len(t, duplicates, 1)
+	assert.Len(t, duplicates["0.0.0.0:8080"], 2)
+	assert.Equal(t, "2", duplicates["0.0.0.0:8080"][1].(RuntimeContainer).ID)
+
+	tests := templateTestList{
+		{`{{range $port, $containers := duplicatePublishedPorts .}}{{$port}}{{end}}`, containers, `0.0.0.0:8080`},
+		{`{{duplicatePublishedPorts . | len}}`, containers[1:], `0`},
+	}
+	tests.run(t, "duplicatePublishedPorts")
+}
+
+func TestWhereCompare(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"REPLICAS": "1",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"REPLICAS": " 2 ",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"REPLICAS": "3",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"REPLICAS": "many",
+			},
+			ID: "4",
+		},
+		{
+			ID: "5",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereCompare . "Env.REPLICAS" ">" 2}}{{.ID}}{{end}}`, containers, `3`},
+		{`{{range whereCompare . "Env.REPLICAS" ">=" 2}}{{.ID}}{{end}}`, containers, `23`},
+		{`{{range whereCompare . "Env.REPLICAS" "<" 2}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereCompare . "Env.REPLICAS" "<=" "2"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereCompare . "Env.REPLICAS" ">" 1.5}}{{.ID}}{{end}}`, containers, `23`},
+		{`{{range whereGreaterThan . "Env.REPLICAS" 1}}{{.ID}}{{end}}`, containers, `23`},
+		{`{{range whereLessThan . "Env.REPLICAS" 3}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereLessThan . "Env.MISSING" 3}}{{.ID}}{{end}}`, containers, ``},
+	}
+
+	tests.run(t, "whereCompare")
+
+	_, err := whereCompare(containers, "Env.REPLICAS", "!=", 2)
+	assert.Error(t, err)
+	_, err = whereCompare(containers, "Env.REPLICAS", ">", "two")
+	assert.Error(t, err)
+	_, err = whereGreaterThan("not a slice", "Env.REPLICAS", 2)
+	assert.Error(t, err)
+}
+
+func TestWhereNumInRange(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "80",
+				"WEIGHT":       "0.5",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "8080",
+				"WEIGHT":       "2",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_PORT": "http",
+				"WEIGHT":       " 1 ",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereNumInRange . "Env.VIRTUAL_PORT" 1 1024}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereNumInRange . "Env.VIRTUAL_PORT" 80 8080}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereNumInRange . "Env.WEIGHT" 0 1}}{{.ID}}{{end}}`, containers, `13`},
+		{`{{range whereNumInRange . "Env.WEIGHT" 0.75 1.5}}{{.ID}}{{end}}`, containers, `3`},
+		{`{{whereNumInRange . "Env.MISSING" 0 100 | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereNumInRange")
+
+	type weighted struct {
+		Weight int
+	}
+	selected, err := whereNumInRange([]weighted{{1}, {5}, {10}}, "Weight", 2, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{weighted{5}, weighted{10}}, selected)
+}
+
+func TestWhereProto(t *testing.T) {
+	container := &RuntimeContainer{
+		Addresses: []Address{
+			{
+				IP:    "172.16.42.1",
+				Port:  "80",
+				Proto: "tcp",
+			},
+			{
+				IP:    "172.16.42.1",
+				Port:  "53",
+				Proto: "udp",
+			},
+			{
+				IP:    "172.16.42.1",
+				Port:  "443",
+				Proto: "tcp",
+			},
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereProto .Addresses "tcp"}}{{.Port}} {{end}}`, container, `80 443 `},
+		{`{{range whereNotProto .Addresses "tcp"}}{{.Port}} {{end}}`, container, `53 `},
+		{`{{whereProto .Addresses "sctp" | len}}`, container, `0`},
+		{`{{whereProto .Addresses "" | len}}`, container, `3`},
+		{`{{whereNotProto .Addresses "" | len}}`, container, `3`},
+	}
+
+	tests.run(t, "whereProto")
+}
+
+func TestWhereAddressPort(t *testing.T) {
+	container := &RuntimeContainer{
+		Addresses: []Address{
+			{
+				IP:    "172.16.42.1",
+				Port:  "80",
+				Proto: "tcp",
+			},
+			{
+				IP:    "172.16.42.1",
+				Port:  "80",
+				Proto: "udp",
+			},
+			{
+				IP:    "172.16.42.1",
+				Port:  "8080",
+				Proto: "tcp",
+			},
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereAddressPort .Addresses 80 | len}}`, container, `2`},
+		{`{{whereAddressPort .Addresses "80" | len}}`, container, `2`},
+		{`{{range whereAddressPort .Addresses 8080}}{{.Proto}}{{end}}`, container, `tcp`},
+		{`{{whereAddressPort .Addresses 443 | len}}`, container, `0`},
+		{`{{whereProto (whereAddressPort .Addresses 80) "udp" | len}}`, container, `1`},
+	}
+
+	tests.run(t, "whereAddressPort")
+}
+
+func TestWhereLabelExists(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.foo": "foo",
+				"com.example.bar": "bar",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.bar": "bar",
+			},
+			ID: "2",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereLabelExists . "com.example.foo" | len}}`, containers, `1`},
+		{`{{whereLabelExists . "com.example.bar" | len}}`, containers, `2`},
+		{`{{whereLabelExists . "com.example.baz" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereLabelExists")
+}
+
+func TestWhereLabelAfterWhere(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			Labels: map[string]string{
+				"com.example.foo": "foo",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			Labels: map[string]string{
+				"com.example.foo": "foo",
+			},
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereLabelExists (where . "Env.VIRTUAL_HOST" "demo1.localhost") "com.example.foo"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereLabelDoesNotExist (whereNot . "Env.VIRTUAL_HOST" "demo2.localhost") "com.example.foo"}}{{.ID}}{{end}}`, containers, `2`},
+		{`{{range where (whereLabelExists . "com.example.foo") "Env.VIRTUAL_HOST" "demo2.localhost"}}{{.ID}}{{end}}`, containers, `3`},
+		{`{{whereLabelExists (where . "Env.VIRTUAL_HOST" "none") "com.example.foo" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereLabelAfterWhere")
+
+	_, err := whereLabelExists([]string{"foo"}, "com.example.foo")
+	assert.Error(t, err)
+}
+
+func TestWhereLabelDoesNotExist(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.foo": "foo",
+				"com.example.bar": "bar",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.bar": "bar",
+			},
+			ID: "2",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereLabelDoesNotExist . "com.example.foo" | len}}`, containers, `1`},
+		{`{{whereLabelDoesNotExist . "com.example.bar" | len}}`, containers, `0`},
+		{`{{whereLabelDoesNotExist . "com.example.baz" | len}}`, containers, `2`},
+	}
+
+	tests.run(t, "whereLabelDoesNotExist")
+}
+
+func TestWhereLabelValueMatches(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.foo": "foo",
+				"com.example.bar": "bar",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.bar": "BAR",
+			},
+			ID: "2",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereLabelValueMatches . "com.example.foo" "^foo$" | len}}`, containers, `1`},
+		{`{{whereLabelValueMatches . "com.example.foo" "\\d+" | len}}`, containers, `0`},
+		{`{{whereLabelValueMatches . "com.example.bar" "^bar$" | len}}`, containers, `1`},
+		{`{{whereLabelValueMatches . "com.example.bar" "^(?i)bar$" | len}}`, containers, `2`},
+		{`{{whereLabelValueMatches . "com.example.bar" ".*" | len}}`, containers, `2`},
+		{`{{whereLabelValueMatches . "com.example.baz" ".*" | len}}`, containers, `0`},
+		{`{{range whereLabelValueNotMatches . "com.example.foo" "^foo$"}}{{.ID}}{{end}}`, containers, `2`},
+		{`{{range whereLabelValueNotMatches . "com.example.bar" "^bar$"}}{{.ID}}{{end}}`, containers, `2`},
+		{`{{whereLabelValueNotMatches . "com.example.baz" ".*" | len}}`, containers, `2`},
+	}
+
+	tests.run(t, "whereLabelValueMatches")
+
+	_, err := whereLabelValueMatches(containers, "com.example.foo", "")
+	assert.Error(t, err)
+	_, err = whereLabelValueMatchesFold(containers, "com.example.foo", "")
+	assert.Error(t, err)
+	_, err = whereLabelValueMatchesExcept(containers, "com.example.foo", "", "bar")
+	assert.Error(t, err)
+	_, err = whereLabelValueMatchesExcept(containers, "com.example.foo", ".*", "")
+	assert.Error(t, err)
+	_, err = whereLabelValueNotMatches(containers, "com.example.foo", "")
+	assert.Error(t, err)
+}
+
+func TestWhereLabelValueEquals(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.foo": "foo",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.foo": "FOO",
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereLabelValueEquals . "com.example.foo" "foo"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{whereLabelValueEquals . "com.example.bar" "" | len}}`, containers, `0`},
+		{`{{range whereLabelValueNotEquals . "com.example.foo" "foo"}}{{.ID}}{{end}}`, containers, `23`},
+		{`{{whereLabelValueNotEquals . "com.example.bar" "" | len}}`, containers, `3`},
+	}
+
+	tests.run(t, "whereLabelValueEquals")
+}
+
+func TestWhereLabelValueMatchesFold(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.bar": "bar",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.bar": "BAR",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.bar": "baz",
+			},
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereLabelValueMatchesFold . "com.example.bar" "^bar$" | len}}`, containers, `2`},
+		{`{{whereLabelValueMatchesFold . "com.example.bar" "^BA" | len}}`, containers, `3`},
+		{`{{whereLabelValueMatchesFold . "com.example.foo" ".*" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereLabelValueMatchesFold")
+
+	_, err := whereLabelValueMatchesFold(containers, "com.example.bar", "(")
+	assert.Error(t, err)
+}
+
+func TestWhereLabelValueMatchesExcept(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.env": "prod",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.env": "prod-canary",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.env": "staging",
+			},
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereLabelValueMatchesExcept . "com.example.env" "^prod" "canary" | len}}`, containers, `1`},
+		{`{{whereLabelValueMatchesExcept . "com.example.env" ".*" "^prod" | len}}`, containers, `1`},
+		{`{{whereLabelValueMatchesExcept . "com.example.env" ".*" "^$" | len}}`, containers, `3`},
+		{`{{whereLabelValueMatchesExcept . "com.example.foo" ".*" "^$" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereLabelValueMatchesExcept")
+
+	_, err := whereLabelValueMatchesExcept(containers, "com.example.env", ".*", "(")
+	assert.Error(t, err)
+}
+
+func TestWhereLabelOrEnvMatches(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"VIRTUAL_HOST": "label.example.com",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "env.example.com",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"VIRTUAL_HOST": "label.example.org",
+			},
+			Env: map[string]string{
+				"VIRTUAL_HOST": "env.example.com",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereLabelOrEnvMatches . "VIRTUAL_HOST" "\\.example\\.com$"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereLabelOrEnvMatches . "VIRTUAL_HOST" "^label\\."}}{{.ID}}{{end}}`, containers, `13`},
+		{`{{range whereLabelOrEnvMatches . "VIRTUAL_HOST" "^env\\."}}{{.ID}}{{end}}`, containers, `2`},
+		{`{{range whereLabelOrEnvMatches . "VIRTUAL_HOST" ".*"}}{{.ID}}{{end}}`, containers, `123`},
+	}
+
+	tests.run(t, "whereLabelOrEnvMatches")
+
+	_, err := whereLabelOrEnvMatches(containers, "VIRTUAL_HOST", "(")
+	assert.Error(t, err)
+}
+
+func TestWhereLabelTrueFalse(t *testing.T) {
+	truthy := []string{"true", "TRUE", "True", "t", "1", "yes", "Yes", "y", "on", "ON", " true "}
+	falsy := []string{"false", "FALSE", "False", "f", "0", "no", "No", "n", "off", "OFF", " off "}
+
+	containers := Context{}
+	for i, value := range truthy {
+		containers = append(containers, &RuntimeContainer{
+			Labels: map[string]string{"com.example.enable": value},
+			ID:     fmt.Sprintf("true-%d", i),
+		})
+	}
+	for i, value := range falsy {
+		containers = append(containers, &RuntimeContainer{
+			Labels: map[string]string{"com.example.enable": value},
+			ID:     fmt.Sprintf("false-%d", i),
+		})
+	}
+	containers = append(containers,
+		&RuntimeContainer{Labels: map[string]string{"com.example.enable": "maybe"}, ID: "unrecognized"},
+		&RuntimeContainer{Labels: map[string]string{"com.example.enable": ""}, ID: "empty"},
+		&RuntimeContainer{ID: "missing"},
+	)
+
+	ids := func(selected Context) []string {
+		result := []string{}
+		for _, container := range selected {
+			result = append(result, container.ID)
+		}
+		return result
+	}
+	expected := func(prefix string, n int, extra ...string) []string {
+		result := []string{}
+		for i := 0; i < n; i++ {
+			result = append(result, fmt.Sprintf("%s-%d", prefix, i))
+		}
+		return append(result, extra...)
+	}
+
+	selected, err := whereLabelTrue(containers, "com.example.enable")
+	assert.NoError(t, err)
+	assert.Equal(t, expected("true", len(truthy)), ids(selected))
+
+	selected, err = whereLabelFalse(containers, "com.example.enable")
+	assert.NoError(t, err)
+	assert.Equal(t, expected("false", len(falsy), "empty", "missing"), ids(selected))
+
+	selected, err = whereLabelTrue(containers, "com.example.enable", true)
+	assert.NoError(t, err)
+	assert.Equal(t, expected("true", len(truthy), "empty", "missing"), ids(selected))
+
+	selected, err = whereLabelFalse(containers, "com.example.enable", true)
+	assert.NoError(t, err)
+	assert.Equal(t, expected("false", len(falsy)), ids(selected))
+
+	_, err = whereLabelTrue(containers, "com.example.enable", true, false)
+	assert.Error(t, err)
+
+	tests := templateTestList{
+		{`{{range whereLabelTrue . "com.example.enable"}}{{.ID}} {{end}}`, containers[:2], `true-0 true-1 `},
+		{`{{len (whereLabelFalse . "com.example.enable" true)}}`, containers[len(containers)-3:], `0`},
+	}
+
+	tests.run(t, "whereLabelTrue")
+}
+
+func TestWhereLabelEqualsEnv(t *testing.T) {
+	color, set := os.LookupEnv("DOCKER_GEN_ACTIVE_COLOR")
+	defer func() {
+		if set {
+			os.Setenv("DOCKER_GEN_ACTIVE_COLOR", color)
+		} else {
+			os.Unsetenv("DOCKER_GEN_ACTIVE_COLOR")
+		}
+	}()
+
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"deploy.color": "blue",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"deploy.color": "green",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"deploy.color": "",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereLabelEqualsEnv . "deploy.color" "DOCKER_GEN_ACTIVE_COLOR"}}{{.ID}}{{end}}`, containers, `1`},
+	}
+	os.Setenv("DOCKER_GEN_ACTIVE_COLOR", "blue")
+	tests.run(t, "whereLabelEqualsEnv")
+
+	os.Setenv("DOCKER_GEN_ACTIVE_COLOR", "green")
+	selected, err := whereLabelEqualsEnv(containers, "deploy.color", "DOCKER_GEN_ACTIVE_COLOR")
+	assert.NoError(t, err)
+	assert.Equal(t, Context{containers[1]}, selected)
+
+	os.Setenv("DOCKER_GEN_ACTIVE_COLOR", "")
+	selected, _ = whereLabelEqualsEnv(containers, "deploy.color", "DOCKER_GEN_ACTIVE_COLOR")
+	assert.Equal(t, Context{containers[2]}, selected)
+
+	os.Unsetenv("DOCKER_GEN_ACTIVE_COLOR")
+	selected, _ = whereLabelEqualsEnv(containers, "deploy.color", "DOCKER_GEN_ACTIVE_COLOR")
+	assert.Empty(t, selected)
+}
+
+func TestWhereLabelValueGlob(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.service": "web-1",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "web-10",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "db",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereLabelValueGlob . "com.example.service" "web-*"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereLabelValueGlob . "com.example.service" "web-?"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereLabelValueGlob . "com.example.service" "db"}}{{.ID}}{{end}}`, containers, `3`},
+		{`{{range whereLabelValueGlob . "com.example.service" "*"}}{{.ID}}{{end}}`, containers, `123`},
+		{`{{whereLabelValueGlob . "com.example.service" "web" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereLabelValueGlob")
+
+	_, err := whereLabelValueGlob(containers, "com.example.service", "web-[")
+	assert.Error(t, err)
+}
+
+func TestWhereAnyLabelExists(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"traefik.enable":   "true",
+				"dockergen.enable": "true",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"dockergen.enable": "true",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{},
+			ID:     "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereAnyLabelExists . (split "traefik.enable,dockergen.enable" ",") | len}}`, containers, `2`},
+		{`{{whereAnyLabelExists . (split "traefik.enable" ",") | len}}`, containers, `1`},
+		{`{{whereAnyLabelExists . (split "com.example.foo" ",") | len}}`, containers, `0`},
+		{`{{whereAllLabelsExist . (split "traefik.enable,dockergen.enable" ",") | len}}`, containers, `1`},
+		{`{{whereAllLabelsExist . (split "dockergen.enable" ",") | len}}`, containers, `2`},
+	}
+
+	tests.run(t, "whereAnyLabelExists")
+
+	selected, _ := whereAnyLabelExists(containers, []string{})
+	assert.Len(t, selected, 0)
+	selected, _ = whereAllLabelsExist(containers, []string{})
+	assert.Len(t, selected, 3)
+}
+
+func TestWhereAnyLabelValueMatches(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"traefik.http.routers.web.rule": "Host(`web.example.com`)",
+				"com.example.role":              "frontend",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.role":   "backend",
+				"com.example.domain": "api.example.com",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.role": "db",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereAnyLabelValueMatches . "\\.example\\.com"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereAnyLabelValueMatches . "^(frontend|db)$"}}{{.ID}}{{end}}`, containers, `13`},
+		{`{{range whereAnyLabelValueMatches . ".*"}}{{.ID}}{{end}}`, containers, `123`},
+		{`{{whereAnyLabelValueMatches . "^cache$" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereAnyLabelValueMatches")
+
+	_, err := whereAnyLabelValueMatches(containers, "")
+	assert.Error(t, err)
+	_, err = whereAnyLabelValueMatches(containers, "(")
+	assert.Error(t, err)
+}
+
+func TestExcludeLabels(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.infra": "true",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.role": "web",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.docker.compose.oneoff": "True",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range excludeLabels . (split "com.example.infra,com.docker.compose.oneoff" ",")}}{{.ID}}{{end}}`, containers, `24`},
+		{`{{range excludeLabels . (split "com.example.infra" ",")}}{{.ID}}{{end}}`, containers, `234`},
+	}
+
+	tests.run(t, "excludeLabels")
+
+	selected, _ := excludeLabels(containers, []string{})
+	assert.Len(t, selected, 4)
+}
+
+func TestActiveContainers(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.service": "web",
+			},
+			State: State{Running: true},
+			ID:    "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "web",
+			},
+			State: State{Running: true, Health: Health{Status: "healthy"}},
+			ID:    "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "web",
+			},
+			State: State{Running: true, Health: Health{Status: "unhealthy"}},
+			ID:    "3",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "web",
+			},
+			State: State{Running: true, Health: Health{Status: "starting"}},
+			ID:    "4",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "web",
+			},
+			State: State{Running: false, Health: Health{Status: "healthy"}},
+			ID:    "5",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.service": "api",
+			},
+			State: State{Running: true, Health: Health{Status: "healthy"}},
+			ID:    "6",
+		},
+		{
+			State: State{Running: true},
+			ID:    "7",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range activeContainers . "com.example.service" "^web$"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range activeContainers . "com.example.service" ".*"}}{{.ID}}{{end}}`, containers, `126`},
+		{`{{range activeContainers . "com.example.service" "^db$"}}{{.ID}}{{end}}`, containers, ``},
+	}
+
+	tests.run(t, "activeContainers")
+
+	_, err := activeContainers(containers, "com.example.service", "")
+	assert.Error(t, err)
+}
+
+func TestExposedPublished(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Addresses: []Address{
+				{
+					IP:       "172.17.0.2",
+					Port:     "80",
+					HostPort: "8080",
+				},
+			},
+			ID: "1",
+		},
+		{
+			Addresses: []Address{
+				{
+					IP:   "172.17.0.3",
+					Port: "5432",
+				},
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range exposed .}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range published .}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range exposed (published .)}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{len (published .)}}`, []*RuntimeContainer{}, `0`},
+	}
+
+	tests.run(t, "exposed")
+
+	_, err := wherePublishedExists("not a slice")
+	assert.Error(t, err)
+}
+
+func TestExcludeSelf(t *testing.T) {
+	hostname := os.Getenv("HOSTNAME")
+	defer os.Setenv("HOSTNAME", hostname)
+	mu.Lock()
+	info := dockerInfo
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		dockerInfo = info
+		mu.Unlock()
+	}()
+
+	containers := Context{
+		{ID: "3c9a1ac5e2e98cbd5b2c3e3c2b7bbbd2a6a3c1b8f0f0e5a4c2d3b4a5f6e7d8c9"},
+		{ID: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+	}
+
+	mu.Lock()
+	dockerInfo = Docker{CurrentContainerID: containers[0].ID}
+	mu.Unlock()
+	selected, err := excludeSelf(containers)
+	assert.NoError(t, err)
+	assert.Equal(t, Context{containers[1]}, selected)
+
+	mu.Lock()
+	dockerInfo = Docker{}
+	mu.Unlock()
+	os.Setenv("HOSTNAME", containers[1].ID[:12])
+	selected, _ = excludeSelf(containers)
+	assert.Equal(t, Context{containers[0]}, selected)
+
+	os.Setenv("HOSTNAME", "customhostname")
+	selected, _ = excludeSelf(containers)
+	assert.Len(t, selected, 2)
+
+	os.Setenv("HOSTNAME", "webfrontend1")
+	assert.False(t, shortIDPattern.MatchString("webfrontend1"))
+	selected, _ = excludeSelf(containers)
+	assert.Len(t, selected, 2)
+}
+
+func TestWhereAddressExists(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Addresses: []Address{
+				{
+					IP:       "172.16.42.1",
+					Port:     "80",
+					HostPort: "8080",
+					Proto:    "tcp",
+				},
+			},
+			ID: "1",
+		},
+		{
+			Addresses: []Address{
+				{
+					IP:    "172.16.42.2",
+					Port:  "80",
+					Proto: "tcp",
+				},
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{whereAddressExists . | len}}`, containers, `2`},
+		{`{{wherePublishedExists . | len}}`, containers, `1`},
+		{`{{range wherePublishedExists .}}{{.ID}}{{end}}`, containers, `1`},
+	}
+
+	tests.run(t, "whereAddressExists")
+}
+
+func TestNetworks(t *testing.T) {
+	container := &RuntimeContainer{
+		ID: "1",
+		Networks: []Network{
+			{Name: "bridge", Gateway: "172.17.0.1", IP: "172.17.0.2"},
+			{Name: "overlay", Gateway: "10.0.0.1", IP: "10.0.0.5"},
+		},
+	}
+	containers := []*RuntimeContainer{container}
+
+	tests := templateTestList{
+		{`{{range networks .}}{{.}};{{end}}`, container, `bridge;overlay;`},
+		{`{{networkGateway . "overlay"}}`, container, `10.0.0.1`},
+		{`{{networkGateway . "macvlan"}}`, container, ``},
+		{`{{networks . | len}}`, &RuntimeContainer{}, `0`},
+		{`{{range where . "ID" "1"}}{{range networks .}}{{.}};{{end}}{{end}}`, containers, `bridge;overlay;`},
+		{`{{range $id, $c := groupBy . "ID"}}{{range $c}}{{networkGateway . "bridge"}}{{end}}{{end}}`, containers, `172.17.0.1`},
+	}
+
+	tests.run(t, "networks")
+
+	names, err := networks(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	gateway, err := networkGateway(nil, "bridge")
+	assert.NoError(t, err)
+	assert.Equal(t, "", gateway)
+	_, err = networks("not a container")
+	assert.Error(t, err)
+	_, err = networkGateway("not a container", "bridge")
+	assert.Error(t, err)
+}
+
+func TestShortID(t *testing.T) {
+	tests := templateTestList{
+		{`{{shortID .}}`, &RuntimeContainer{ID: "0123456789abcdef0123456789abcdef"}, `0123456789ab`},
+		{`{{shortID .}}`, &RuntimeContainer{ID: "0123456789ab"}, `0123456789ab`},
+		{`{{shortID .}}`, &RuntimeContainer{ID: "0123"}, `0123`},
+		{`# {{.}}`, &RuntimeContainer{ID: "0123456789abcdef", Name: "web"}, `# web (0123456789ab)`},
+		{`{{range where . "Name" "web"}}{{shortID .}}{{end}}`, []*RuntimeContainer{{ID: "0123456789abcdef", Name: "web"}}, `0123456789ab`},
+		{`{{range where . "Name" "web"}}# {{.}} {{.ShortID}}{{end}}`, []*RuntimeContainer{{ID: "0123456789abcdef", Name: "web"}}, `# web (0123456789ab) 0123456789ab`},
+	}
+
+	tests.run(t, "shortID")
+
+	id, err := shortID(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", id)
+	_, err = shortID("0123456789abcdef")
+	assert.Error(t, err)
+}
+
+func TestPublishedPortsInRange(t *testing.T) {
+	container := &RuntimeContainer{
+		Addresses: []Address{
+			{IP: "172.16.42.1", Port: "80", HostPort: "8080"},
+			{IP: "172.16.42.1", Port: "443", HostPort: "8443"},
+			{IP: "172.16.42.1", Port: "9000", HostPort: "9000"},
+			{IP: "172.16.42.1", Port: "22", HostPort: "2222"},
+			{IP: "172.16.42.1", Port: "8081"},
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range publishedPortsInRange . 8000 8999}}{{.HostPort}};{{end}}`, container, `8080;8443;`},
+		{`{{range publishedPortsInRange . 8443 9000}}{{.Port}};{{end}}`, container, `443;9000;`},
+		{`{{publishedPortsInRange . 10000 20000 | len}}`, container, `0`},
+		{`{{publishedPortsInRange . 9000 8000 | len}}`, container, `0`},
+		{`{{range whereAddressExists .}}{{range publishedPortsInRange . 8000 8999}}{{.HostPort}};{{end}}{{end}}`, []*RuntimeContainer{container}, `8080;8443;`},
+	}
+
+	tests.run(t, "publishedPortsInRange")
+
+	addresses, err := publishedPortsInRange(nil, 0, 65535)
+	assert.NoError(t, err)
+	assert.Empty(t, addresses)
+	addresses, err = publishedPortsInRange(RuntimeContainer{
+		Addresses: []Address{{Port: "80", HostPort: "http"}},
+	}, 0, 65535)
+	assert.NoError(t, err)
+	assert.Empty(t, addresses)
+	_, err = publishedPortsInRange("not a container", 0, 65535)
+	assert.Error(t, err)
+}
+
+func TestWhereIPInCidr(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Addresses: []Address{
+				{IP: "10.0.0.5", Port: "80"},
+				{IP: "172.16.42.1", Port: "443"},
+			},
+			ID: "1",
+		},
+		{
+			Addresses: []Address{
+				{IP: "172.16.43.2", Port: "80"},
+			},
+			ID: "2",
+		},
+		{
+			Addresses: []Address{
+				{IP: "", Port: "80"},
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range whereIPInCidr . "172.16.42.0/24"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereIPInCidr . "172.16.0.0/16"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{range whereIPInCidr . "10.0.0.5/32"}}{{.ID}}{{end}}`, containers, `1`},
+		{`{{range whereIPInCidr . "0.0.0.0/0"}}{{.ID}}{{end}}`, containers, `12`},
+		{`{{whereIPInCidr . "192.168.0.0/16" | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "whereIPInCidr")
+
+	_, err := whereIPInCidr(containers, "172.16.42.0")
+	assert.Error(t, err)
+	_, err = whereIPInCidr(containers, "172.16.42.0/33")
+	assert.Error(t, err)
+}
+
+func TestEnvWithPrefix(t *testing.T) {
+	container := &RuntimeContainer{
+		Env: map[string]string{
+			"SERVICE_NAME":     "web",
+			"SERVICE_80_NAME":  "http",
+			"SERVICE_443_NAME": "https",
+			"SERVICE_":         "empty",
+			"MY_SERVICE_NAME":  "other",
+			"PATH":             "/usr/bin",
+		},
+	}
+
+	env, err := envWithPrefix(container, "SERVICE_")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"NAME":     "web",
+		"80_NAME":  "http",
+		"443_NAME": "https",
+	}, env)
+	env, err = envWithPrefix(*container, "SERVICE_80_")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"NAME": "http",
+	}, env)
+	env, _ = envWithPrefix(container, "MISSING_")
+	assert.Empty(t, env)
+	env, _ = envWithPrefix(nil, "SERVICE_")
+	assert.Empty(t, env)
+	_, err = envWithPrefix("not a container", "SERVICE_")
+	assert.Error(t, err)
+
+	tests := templateTestList{
+		{`{{index (envWithPrefix . "SERVICE_") "NAME"}}`, container, `web`},
+		{`{{range $name, $c := groupBy . "Env.SERVICE_NAME"}}{{range $c}}{{index (envWithPrefix . "SERVICE_") "80_NAME"}}{{end}}{{end}}`, []*RuntimeContainer{container}, `http`},
+	}
+	tests.run(t, "envWithPrefix")
+}
+
+func TestLabelValueExtract(t *testing.T) {
+	container := &RuntimeContainer{
+		Labels: map[string]string{
+			"com.example.rule": "Host(`demo.example.com`) && PathPrefix(`/api`)",
+			"com.example.port": "port-8080",
+		},
+	}
+
+	tests := templateTestList{
+		{"{{labelValueExtract . \"com.example.rule\" \"Host\\\\(`([^`]+)`\\\\)\"}}", container, `demo.example.com`},
+		{`{{labelValueExtract . "com.example.port" "[0-9]+"}}`, container, `8080`},
+		{`{{labelValueExtract . "com.example.port" "^[a-z]+$"}}`, container, ``},
+		{`{{labelValueExtract . "com.example.missing" ".*"}}`, container, ``},
+		{`{{range whereLabelExists . "com.example.port"}}{{labelValueExtract . "com.example.port" "[0-9]+"}}{{end}}`, []*RuntimeContainer{container}, `8080`},
+	}
+
+	tests.run(t, "labelValueExtract")
+
+	_, err := labelValueExtract(container, "com.example.port", "(")
+	assert.Error(t, err)
+	_, err = labelValueExtract(container, "com.example.port", "")
+	assert.EqualError(t, err, `empty pattern passed to 'labelValueExtract'; use ".*" to extract the whole value`)
+	_, err = labelValueExtract("not a container", "com.example.port", "[0-9]+")
+	assert.Error(t, err)
+}
+
+func TestLabelValueMatches(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.tier": "frontend",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.tier": "backend",
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range .}}{{if labelValueMatches . "com.example.tier" "^front"}}{{.ID}}{{end}}{{end}}`, containers, `1`},
+		{`{{range .}}{{if labelValueMatches . "com.example.tier" "end$"}}{{.ID}}{{end}}{{end}}`, containers, `12`},
+		{`{{range .}}{{labelValueMatches . "com.example.tier" ".*"}};{{end}}`, containers, `true;true;false;`},
+		{`{{range $id, $c := groupBy . "ID"}}{{range $c}}{{if labelValueMatches . "com.example.tier" "^back"}}{{.ID}}{{end}}{{end}}{{end}}`, containers, `2`},
+		{`{{range where . "ID" "1"}}{{labelValueMatches . "com.example.tier" "^front"}}{{end}}`, containers, `true`},
+	}
+
+	tests.run(t, "labelValueMatches")
+
+	_, err := labelValueMatches(containers[0], "com.example.tier", "(")
+	assert.Error(t, err)
+	_, err = labelValueMatches(containers[0], "com.example.tier", "")
+	assert.Error(t, err)
+	matched, err := labelValueMatches(nil, "com.example.tier", ".*")
+	assert.NoError(t, err)
+	assert.False(t, matched)
+	matched, err = labelValueMatches(*containers[1], "com.example.tier", "^back")
+	assert.NoError(t, err)
+	assert.True(t, matched)
+	_, err = labelValueMatches("not a container", "com.example.tier", ".*")
+	assert.Error(t, err)
+}
+
+func TestLabelFromList(t *testing.T) {
+	container := &RuntimeContainer{
+		Labels: map[string]string{
+			"com.example.host":     "fallback.localhost",
+			"com.example.vhost":    "demo.localhost",
+			"com.example.disabled": "",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{labelFromList . (split "com.example.vhost,com.example.host" ",")}}`, container, `demo.localhost`},
+		{`{{labelFromList . (split "com.example.host,com.example.vhost" ",")}}`, container, `fallback.localhost`},
+		{`{{labelFromList . (split "com.example.missing,com.example.host" ",")}}`, container, `fallback.localhost`},
+		{`{{labelFromList . (split "com.example.disabled,com.example.host" ",")}}`, container, ``},
+		{`{{labelFromList . (split "com.example.missing" ",")}}`, container, ``},
+		{`{{range whereLabelExists . "com.example.vhost"}}{{labelFromList . (split "com.example.vhost,com.example.host" ",")}}{{end}}`, []*RuntimeContainer{container}, `demo.localhost`},
+	}
+
+	tests.run(t, "labelFromList")
+
+	value, err := labelFromList(container, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+	value, err = labelFromList(nil, []string{"com.example.host"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+	_, err = labelFromList("not a container", []string{"com.example.host"})
+	assert.Error(t, err)
+}
+
+func TestRegexFindAll(t *testing.T) {
+	container := &RuntimeContainer{
+		Labels: map[string]string{
+			"com.example.backends": "web1:80, web2:8080,web3:443",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range regexFindAll "[a-z0-9]+:[0-9]+" (index .Labels "com.example.backends") -1}}{{.}} {{end}}`, container, `web1:80 web2:8080 web3:443 `},
+		{`{{range regexFindAll "[0-9]+" "a1b22c333" 2}}{{.}} {{end}}`, nil, `1 22 `},
+		{`{{len (regexFindAll "[0-9]+" "abc" -1)}}`, nil, `0`},
+	}
+
+	tests.run(t, "regexFindAll")
+
+	matches, err := regexFindAll(":[0-9]+", container.Labels["com.example.backends"], -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":80", ":8080", ":443"}, matches)
+
+	matches, err = regexFindAll(":[0-9]+", container.Labels["com.example.backends"], 0)
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+
+	_, err = regexFindAll("(unclosed", "value", -1)
+	assert.Error(t, err)
+}
+
+func TestRegexMatchCompiled(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Name: "web-1",
+			ID:   "1",
+		},
+		{
+			Name: "db-1",
+			ID:   "2",
+		},
+		{
+			Name: "web-2",
+			ID:   "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{$rx := compileRegex "^web-"}}{{range .}}{{if regexMatchCompiled $rx .Name}}{{.ID}}{{end}}{{end}}`, containers, `13`},
+	}
+
+	tests.run(t, "regexMatchCompiled")
+
+	rx1, err := compileRegexp("^web-")
+	assert.NoError(t, err)
+	rx2, _ := compileRegexp("^web-")
+	assert.True(t, rx1 == rx2, "Expected compiled pattern to be reused")
+
+	_, err = compileRegexp("(")
+	assert.Error(t, err)
+
+	for i := 0; i < 2*maxCachedRegexps; i++ {
+		_, err = compileRegexp(fmt.Sprintf("^web-%d$", i))
+		assert.NoError(t, err)
+	}
+	regexpCache.Lock()
+	cached := len(regexpCache.m)
+	regexpCache.Unlock()
+	assert.True(t, cached <= maxCachedRegexps, "Expected at most %d cached patterns, got %d", maxCachedRegexps, cached)
+}
+
+func TestHasPrefix(t *testing.T) {
+	const prefix = "tcp://"
+	const str = "tcp://127.0.0.1:2375"
+	if !hasPrefix(prefix, str) {
+		t.Fatalf("expected %s to have prefix %s", str, prefix)
+	}
+}
+
+func TestHasSuffix(t *testing.T) {
+	const suffix = ".local"
+	const str = "myhost.local"
+	if !hasSuffix(suffix, str) {
+		t.Fatalf("expected %s to have suffix %s", str, suffix)
+	}
+}
+
+func TestSplitN(t *testing.T) {
+	tests := templateTestList{
+		{`{{index (splitN . "/" 2) 0}}`, "example.com/path", `example.com`},
+		{`{{index (splitN . "/" 2) 1}}`, "example.com/path", `path`},
+		{`{{index (splitN . "/" 2) 1}}`, "example.com/a/longer/path", `a/longer/path`},
+		{`{{len (splitN . "/" 2)}}`, "example.com", `1`},
+	}
+
+	tests.run(t, "splitN")
+}
+
+func TestTrimQuotes(t *testing.T) {
+	tests := templateTestList{
+		{`{{trimQuotes .}}`, `"demo.localhost"`, `demo.localhost`},
+		{`{{trimQuotes .}}`, `'demo.localhost'`, `demo.localhost`},
+		{`{{trimQuotes .}}`, `""demo.localhost""`, `"demo.localhost"`},
+		{`{{trimQuotes .}}`, `"say 'hi'"`, `say 'hi'`},
+		{`{{trimQuotes .}}`, `"demo.localhost'`, `"demo.localhost'`},
+		{`{{trimQuotes .}}`, `"demo.localhost`, `"demo.localhost`},
+		{`{{trimQuotes .}}`, `demo.localhost`, `demo.localhost`},
+		{`{{trimQuotes .}}`, `"`, `"`},
+		{`{{trimQuotes .}}`, `""`, ``},
+	}
+
+	tests.run(t, "trimQuotes")
+}
+
+func TestSplitTrimN(t *testing.T) {
+	tests := templateTestList{
+		{`{{index (splitTrimN . ":" 2) 0}}|`, "host : 8080", `host|`},
+		{`{{index (splitTrimN . ":" 2) 1}}|`, "host : 8080", `8080|`},
+		{`{{index (splitTrimN . "=" 2) 1}}|`, " key = a = b ", `a = b|`},
+		{`{{len (splitTrimN . "," -1)}}`, "a , b , c", `3`},
+		{`{{index (splitN . ":" 2) 0}}|`, "host : 8080", `host |`},
+	}
+
+	tests.run(t, "splitTrimN")
+}
+
+func TestReplaceMap(t *testing.T) {
+	tests := templateTestList{
+		{`{{replaceMap (dict "_" "-" ".local" ".example.com") .}}`, "my_host.local", `my-host.example.com`},
+		{`{{replaceMap (dict "a" "b" "b" "c") .}}`, "ab", `cc`},
+		{`{{replaceMap (dict) .}}`, "ab", `ab`},
+	}
+
+	tests.run(t, "replaceMap")
+
+	got, err := replaceMap(map[string]string{"foo": "bar"}, "foo.foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar.bar", got)
+
+	_, err = replaceMap([]string{"foo"}, "foo")
+	assert.Error(t, err)
+}
+
+func TestReplaceFirst(t *testing.T) {
+	tests := templateTestList{
+		{`{{replaceFirst "/api" "" .}}`, "/api/v1/api", `/v1/api`},
+		{`{{replaceFirst "a" "b" .}}`, "aaa", `baa`},
+		{`{{replaceFirst "x" "y" .}}`, "aaa", `aaa`},
+		{`{{. | replaceFirst "-" "."}}`, "web-1-blue", `web.1-blue`},
+	}
+
+	tests.run(t, "replaceFirst")
+}
+
+func TestTrimPrefix(t *testing.T) {
+	const prefix = "tcp://"
+	const str = "tcp://127.0.0.1:2375"
+	const trimmed = "127.0.0.1:2375"
+	got := trimPrefix(prefix, str)
+	if got != trimmed {
+		t.Fatalf("expected trimPrefix(%s,%s) to be %s, got %s", prefix, str, trimmed, got)
+	}
+}
+
+func TestTrimSuffix(t *testing.T) {
+	const suffix = ".local"
+	const str = "myhost.local"
+	const trimmed = "myhost"
+	got := trimSuffix(suffix, str)
+	if got != trimmed {
+		t.Fatalf("expected trimSuffix(%s,%s) to be %s, got %s", suffix, str, trimmed, got)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	const str = "  myhost.local  "
+	const trimmed = "myhost.local"
+	got := trim(str)
+	if got != trimmed {
+		t.Fatalf("expected trim(%s) to be %s, got %s", str, trimmed, got)
+	}
+}
+
+func TestTrimTrailingSpace(t *testing.T) {
+	const str = "server {  \n\tlisten 80;\t\n\n  location / { }\r\n}  "
+	const trimmed = "server {\n\tlisten 80;\n\n  location / { }\r\n}"
+	assert.Equal(t, trimmed, trimTrailingSpace(str), "Unexpected value from trimTrailingSpace()")
+	assert.Equal(t, "a\r\n\tb\r\n", trimTrailingSpace("a \t\r\n\tb\r\n"))
+}
+
+func TestTpl(t *testing.T) {
+	container := &RuntimeContainer{
+		Name: "web",
+		Labels: map[string]string{
+			"com.example.host":   "{{.Name}}.example.com",
+			"com.example.nested": `{{tpl "{{.Name}}-nested" .}}`,
+			"com.example.loop":   `{{tpl (index .Labels "com.example.loop") .}}`,
+		},
+	}
+
+	tests := templateTestList{
+		{`{{tpl (index .Labels "com.example.host") .}}`, container, `web.example.com`},
+		{`{{tpl (index .Labels "com.example.nested") .}}`, container, `web-nested`},
+		{`{{tpl "plain" .}}`, container, `plain`},
+	}
+
+	tests.run(t, "tpl")
+
+	_, err := tpl(0, nil)(container.Labels["com.example.loop"], container)
+	assert.Error(t, err)
+
+	_, err = tpl(0, nil)("{{.Name", container)
+	assert.Error(t, err)
+
+	_, err = tpl(0, nil)("{{.Missing.Field}}", container)
+	assert.Error(t, err)
+}
+
+func TestToLower(t *testing.T) {
+	const str = ".RaNd0m StrinG_"
+	const lowered = ".rand0m string_"
+	assert.Equal(t, lowered, toLower(str), "Unexpected value from toLower()")
+}
+
+func TestToUpper(t *testing.T) {
+	const str = ".RaNd0m StrinG_"
+	const uppered = ".RAND0M STRING_"
+	assert.Equal(t, uppered, toUpper(str), "Unexpected value from toUpper()")
+}
+
+func TestDict(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "3",
+		},
+	}
+	d, err := dict("/", containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["/"] == nil {
+		t.Fatalf("did not find containers in dict: %s", d)
+	}
+	if d["MISSING"] != nil {
+		t.Fail()
+	}
+}
+
+func TestSha1(t *testing.T) {
+	sum := hashSha1("/path")
+	if sum != "4f26609ad3f5185faaa9edf1e93aa131e2131352" {
+		t.Fatal("Incorrect SHA1 sum")
+	}
+}
+
+func TestHashStruct(t *testing.T) {
+	const expected = "ecf9e98ec0641e23113ff3ce8bdc78d0ddd249886517fd4a7f68cc83d4e65667"
+
+	sum, err := hashStruct(map[string]interface{}{"b": "x", "a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, sum)
+
+	sum, err = hashStruct(struct {
+		B string `json:"b"`
+		A int    `json:"a"`
+	}{"x", 1})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, sum, "struct fields should be sorted like map keys")
+
+	containers := Context{
+		{ID: "1", Labels: map[string]string{"com.example.foo": "foo", "com.example.bar": "bar"}},
+		{ID: "2", Env: map[string]string{"VIRTUAL_HOST": "demo.localhost"}},
+	}
+	first, err := hashStruct(containers)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		sum, _ := hashStruct(containers)
+		assert.Equal(t, first, sum)
+	}
+
+	sum, _ = hashStruct(containers[:1])
+	assert.NotEqual(t, first, sum)
+
+	_, err = hashStruct(func() {})
+	assert.Error(t, err)
+}
+
+func TestHexEncode(t *testing.T) {
+	tests := templateTestList{
+		{`{{hexEncode .}}`, "/path", `2f70617468`},
+		{`{{hexDecode .}}`, "2f70617468", `/path`},
+		{`{{hexEncode . | hexDecode}}`, "docker-gen", `docker-gen`},
+	}
+
+	tests.run(t, "hexEncode")
+
+	_, err := hexDecode("zz")
+	assert.Error(t, err)
+}
+
+func TestBase32Encode(t *testing.T) {
+	tests := templateTestList{
+		{`{{base32Encode .}}`, "/path", `F5YGC5DI`},
+		{`{{base32Decode .}}`, "F5YGC5DI", `/path`},
+		{`{{base32Encode . | base32Decode}}`, "docker-gen", `docker-gen`},
+	}
+
+	tests.run(t, "base32Encode")
+
+	_, err := base32Decode("!!")
+	assert.Error(t, err)
+}
+
+func TestJson(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "3",
+		},
+	}
+	output, err := marshalJson(containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBufferString(output)
+	dec := json.NewDecoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []*RuntimeContainer
+	if err := dec.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(containers) {
+		t.Fatalf("Incorrect unmarshaled container count. Expected %d, got %d.", len(containers), len(decoded))
+	}
+}
+
+func TestToYamlBlock(t *testing.T) {
+	labels := map[string]interface{}{
+		"name":  "web",
+		"ports": []int{80, 443},
+	}
+
+	block, err := toYamlBlock(4, labels)
+	assert.NoError(t, err)
+	assert.Equal(t, "\n    name: web\n    ports:\n      - 80\n      - 443", block)
+
+	block, err = toYamlBlock(2, map[string]interface{}{"web": map[string]int{"port": 80}})
+	assert.NoError(t, err)
+	assert.Equal(t, "\n  web:\n    port: 80", block)
+
+	tests := templateTestList{
+		{"metadata:{{toYamlBlock 2 .}}\n", map[string]string{"app": "web"}, "metadata:\n  app: web\n"},
+		{"value: {{toYamlBlock 2 .}}", "plain", "value: \n  plain"},
+	}
+	tests.run(t, "toYamlBlock")
+}
+
+func TestToProperties(t *testing.T) {
+	props := map[string]string{
+		"server.port":  "8080",
+		"db.url":       "jdbc:mysql://db:3306/app",
+		"key=with:sep": "a=b",
+		"multi line":   "first\nsecond",
+		"#comment":     " leading space",
+		"path":         `C:\data`,
+	}
+
+	expected := `\#comment=\ leading space
+db.url=jdbc\:mysql\://db\:3306/app
+key\=with\:sep=a\=b
+multi\ line=first\nsecond
+path=C\:\\data
+server.port=8080
+`
+	assert.Equal(t, expected, toProperties(props))
+	assert.Equal(t, "", toProperties(map[string]string{}))
+
+	tests := templateTestList{
+		{`{{toProperties .Labels}}`, &RuntimeContainer{Labels: map[string]string{"b": "2", "a": "1"}}, "a=1\nb=2\n"},
+	}
+	tests.run(t, "toProperties")
+}
+
+func TestParseJson(t *testing.T) {
+	tests := templateTestList{
+		{`{{parseJson .}}`, `null`, `<no value>`},
+		{`{{parseJson .}}`, `true`, `true`},
+		{`{{parseJson .}}`, `1`, `1`},
+		{`{{parseJson .}}`, `0.5`, `0.5`},
+		{`{{index (parseJson .) "enabled"}}`, `{"enabled":true}`, `true`},
+		{`{{index (parseJson . | first) "enabled"}}`, `[{"enabled":true}]`, `true`},
+	}
+
+	tests.run(t, "parseJson")
+}
+
+func TestToCsv(t *testing.T) {
+	output, err := marshalCsv([][]string{
+		{"name", "address"},
+		{"web", "172.16.42.1:80"},
+		{"db, primary", `say "hi"`},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "name,address\nweb,172.16.42.1:80\n\"db, primary\",\"say \"\"hi\"\"\"\n", output)
+}
+
+func TestFromCsv(t *testing.T) {
+	tests := templateTestList{
+		{`{{index (index (fromCsv .) 1) 0}}`, "name,address\n\"db, primary\",172.16.42.1\n", `db, primary`},
+		{`{{len (fromCsv .)}}`, "a,b\nc,d\n", `2`},
+		{`{{fromCsv . | toCsv}}`, "a,\"b,c\"\n", "a,\"b,c\"\n"},
+	}
+
+	tests.run(t, "fromCsv")
+
+	_, err := unmarshalCsv("a,b\nc\n")
+	assert.Error(t, err)
+}
+
+func TestMustParseJson(t *testing.T) {
+	tests := templateTestList{
+		{`{{index (mustParseJson .) "enabled"}}`, `{"enabled":true}`, `true`},
+	}
+
+	tests.run(t, "mustParseJson")
+
+	_, err := mustUnmarshalJson(`{"enabled":`)
+	assert.EqualError(t, err, `unable to parse JSON "{\"enabled\":": unexpected end of JSON input`)
+
+	tmpl := template.Must(newTemplate("mustParseJson").Parse(`{{mustParseJson .}}`))
+	err = tmpl.Execute(ioutil.Discard, `[1, 2`)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `"[1, 2"`)
+}
+
+func TestParseJsonRequire(t *testing.T) {
+	tests := templateTestList{
+		{`{{index (parseJsonRequire . "host" "port") "host"}}`, `{"host":"demo.localhost","port":80}`, `demo.localhost`},
+		{`{{index (parseJsonRequire .) 0}}`, `[1, 2]`, `1`},
+	}
+
+	tests.run(t, "parseJsonRequire")
+
+	_, err := unmarshalJsonRequire(`{"host":"demo.localhost"}`, "host", "port", "proto")
+	assert.EqualError(t, err, "JSON object is missing the keys [port proto]")
+
+	_, err = unmarshalJsonRequire(`["host"]`, "host")
+	assert.EqualError(t, err, `JSON must be an object with the keys [host]; received ["host"]`)
+
+	_, err = unmarshalJsonRequire(`{"host":`, "host")
+	assert.Error(t, err)
+
+	tmpl := template.Must(newTemplate("parseJsonRequire").Parse(`{{parseJsonRequire . "port"}}`))
+	err = tmpl.Execute(ioutil.Discard, `{"host":"demo.localhost"}`)
+	assert.Error(t, err)
+}
+
+func TestJsonEscape(t *testing.T) {
+	tests := templateTestList{
+		{`{{jsonEscape .}}`, `plain`, `plain`},
+		{`{{jsonEscape .}}`, `say "hi" \ <b>`, `say \"hi\" \\ <b>`},
+		{`{{jsonEscape .}}`, "line1\nline2\t\x01", `line1\nline2\t\u0001`},
+		{`{{jsonEscape . | jsonUnescape}}`, "say \"hi\"\n\\", "say \"hi\"\n\\"},
+		{`{{jsonUnescape .}}`, `café`, `café`},
+	}
+
+	tests.run(t, "jsonEscape")
+
+	_, err := jsonUnescape(`bad " quote`)
+	assert.Error(t, err)
+	_, err = jsonUnescape(`trailing \`)
+	assert.Error(t, err)
+}
+
+func TestQuoteJoin(t *testing.T) {
+	tests := templateTestList{
+		{`{{quoteJoin "," .}}`, []string{"a", "b", "c"}, `"a","b","c"`},
+		{`[{{quoteJoin ", " .}}]`, []string{"foo.localhost", `say "hi"`}, `["foo.localhost", "say \"hi\""]`},
+		{`{{quoteJoin " " .}}`, []int{80, 443}, `"80" "443"`},
+		{`{{quoteJoin "," .}}`, []string{}, ``},
+	}
+
+	tests.run(t, "quoteJoin")
+
+	_, err := quoteJoin(",", "not a slice")
+	assert.Error(t, err)
+}
+
+func TestQueryEscape(t *testing.T) {
+	tests := templateTestList{
+		{`{{queryEscape .}}`, `example.com`, `example.com`},
+		{`{{queryEscape .}}`, `.example.com`, `.example.com`},
+		{`{{queryEscape .}}`, `*.example.com`, `%2A.example.com`},
+		{`{{queryEscape .}}`, `~^example\.com(\..*\.xip\.io)?$`, `~%5Eexample%5C.com%28%5C..%2A%5C.xip%5C.io%29%3F%24`},
+	}
+
+	tests.run(t, "queryEscape")
+}
+
+func TestToQueryString(t *testing.T) {
+	tests := templateTestList{
+		{`{{toQueryString .}}`, map[string]string{"b": "2", "a": "1", "c": "3"}, `a=1&b=2&c=3`},
+		{`{{toQueryString .}}`, map[string]string{"redirect": "https://example.com/a b", "q": "x&y=z"}, `q=x%26y%3Dz&redirect=https%3A%2F%2Fexample.com%2Fa+b`},
+		{`{{toQueryString (dict "page" 2 "sort" "name")}}`, nil, `page=2&sort=name`},
+		{`{{toQueryString (dict)}}`, nil, ``},
+	}
+
+	tests.run(t, "toQueryString")
+
+	for i := 0; i < 10; i++ {
+		query, err := toQueryString(map[string]string{"d": "4", "c": "3", "b": "2", "a": "1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "a=1&b=2&c=3&d=4", query)
+	}
+
+	_, err := toQueryString("a=1")
+	assert.Error(t, err)
+}
+
+func TestConcat(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo3.localhost",
+			},
+			ID: "3",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range concat (where . "ID" "3") (where . "ID" "1")}}{{.ID}}{{end}}`, containers, `31`},
+		{`{{range concat (where . "ID" "1") (where . "ID" "2") (where . "ID" "3")}}{{.ID}}{{end}}`, containers, `123`},
+		{`{{range concat . nil (where . "ID" "2")}}{{.ID}}{{end}}`, containers, `1232`},
+		{`{{concat | len}}`, containers, `0`},
+	}
+
+	tests.run(t, "concat")
+
+	list, err := concat([]string{"a", "b"}, []int{1})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b", 1}, list)
+
+	_, err = concat([]string{"a"}, "b")
+	assert.Error(t, err)
+}
+
+func TestSortByLabel(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"com.example.priority": "10",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.priority": "9",
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.priority": "high",
+			},
+			ID: "4",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.priority": "9",
+			},
+			ID: "5",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range sortByLabel . "com.example.priority"}}{{.ID}};{{end}}`, containers, `3;1;2;5;4;`},
+		{`{{range sortByLabelNumeric . "com.example.priority"}}{{.ID}};{{end}}`, containers, `2;5;1;3;4;`},
+		{`{{range sortByLabel . "com.example.missing"}}{{.ID}};{{end}}`, containers, `1;2;3;4;5;`},
+	}
+
+	tests.run(t, "sortByLabel")
+
+	_, err := sortByLabel([]string{"foo"}, "com.example.priority")
+	assert.Error(t, err)
+	_, err = sortByLabelNumeric([]string{"foo"}, "com.example.priority")
+	assert.Error(t, err)
+}
+
+func TestArrayFirstLast(t *testing.T) {
+	tests := templateTestList{
+		{`{{first .}}`, []string{"a", "b", "c"}, `a`},
+		{`{{last .}}`, []string{"a", "b", "c"}, `c`},
+		{`{{first .}}`, map[string]string{"only": "value"}, `value`},
+		{`{{last .}}`, map[string]string{"only": "value"}, `value`},
+		{`{{first .}}`, map[string]int{"b": 2, "a": 1, "c": 3}, `1`},
+		{`{{last .}}`, map[string]int{"b": 2, "a": 1, "c": 3}, `3`},
+		{`{{first (dict "VIRTUAL_HOST" "demo.localhost")}}`, nil, `demo.localhost`},
+	}
+
+	tests.run(t, "first")
+
+	assert.Nil(t, arrayFirst([]string{}))
+	assert.Nil(t, arrayFirst(map[string]string{}))
+	assert.Nil(t, arrayLast(map[string]string{}))
+}
+
+func TestStablePick(t *testing.T) {
+	hosts := []string{"web1", "web2", "web3", "web4"}
+	shuffled := []string{"web3", "web1", "web4", "web2"}
+
+	picks := map[interface{}]bool{}
+	for _, seed := range []string{"a.localhost", "b.localhost", "c.localhost", "d.localhost", "e.localhost"} {
+		pick, err := stablePick(seed, hosts)
+		assert.NoError(t, err)
+		again, _ := stablePick(seed, shuffled)
+		assert.Equal(t, pick, again, "the pick should not depend on the order of the list")
+		picks[pick] = true
+	}
+	assert.True(t, len(picks) > 1, "different seeds should pick different elements")
+
+	containers := Context{{ID: "1"}, {ID: "2"}}
+	pick, err := stablePick("demo.localhost", containers)
+	assert.NoError(t, err)
+	assert.IsType(t, &RuntimeContainer{}, pick)
+
+	tests := templateTestList{
+		{`{{(stablePick "demo.localhost" .).ID}}`, containers, pick.(*RuntimeContainer).ID},
+	}
+	tests.run(t, "stablePick")
+
+	pick, err = stablePick("demo.localhost", []string{})
+	assert.NoError(t, err)
+	assert.Nil(t, pick)
+
+	_, err = stablePick("demo.localhost", "web1")
+	assert.Error(t, err)
+}
+
+func TestArrayClosestExact(t *testing.T) {
+	if arrayClosest([]string{"foo.bar.com", "bar.com"}, "foo.bar.com") != "foo.bar.com" {
+		t.Fatal("Expected foo.bar.com")
+	}
+}
+
+func TestArrayClosestSubstring(t *testing.T) {
+	if arrayClosest([]string{"foo.fo.com", "bar.com"}, "foo.bar.com") != "bar.com" {
+		t.Fatal("Expected bar.com")
+	}
+}
+
+func TestArrayClosestNoMatch(t *testing.T) {
+	if arrayClosest([]string{"foo.fo.com", "bip.com"}, "foo.bar.com") != "" {
+		t.Fatal("Expected ''")
+	}
+}
+
+func TestHumanizeBytes(t *testing.T) {
+	assert.Equal(t, "0 B", humanizeBytes(0))
+	assert.Equal(t, "1023 B", humanizeBytes(1023))
+	assert.Equal(t, "1.0 KiB", humanizeBytes(1024))
+	assert.Equal(t, "1.0 KiB", humanizeBytes(1025))
+	assert.Equal(t, "1.5 KiB", humanizeBytes(1536))
+	assert.Equal(t, "1023.9 KiB", humanizeBytes(1024*1024-60))
+	assert.Equal(t, "1.0 MiB", humanizeBytes(1024*1024-1))
+	assert.Equal(t, "1.0 MiB", humanizeBytes(1024*1024))
+	assert.Equal(t, "1.5 GiB", humanizeBytes(1536*1024*1024))
+	assert.Equal(t, "-2.0 KiB", humanizeBytes(-2048))
+
+	tests := templateTestList{
+		{`{{humanizeBytes 1073741824}}`, nil, `1.0 GiB`},
+	}
+	tests.run(t, "humanizeBytes")
+}
+
+func TestHumanizeBytesSI(t *testing.T) {
+	assert.Equal(t, "999 B", humanizeBytesSI(999))
+	assert.Equal(t, "1.0 kB", humanizeBytesSI(1000))
+	assert.Equal(t, "1.0 kB", humanizeBytesSI(1023))
+	assert.Equal(t, "1.0 kB", humanizeBytesSI(1024))
+	assert.Equal(t, "1.0 kB", humanizeBytesSI(1025))
+	assert.Equal(t, "2.5 MB", humanizeBytesSI(2500000))
+	assert.Equal(t, "1.0 MB", humanizeBytesSI(999999))
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := templateTestList{
+		{`{{parseDuration . | formatDuration}}`, `30s`, `30s`},
+		{`{{parseDuration . | formatDuration}}`, `90s`, `1m30s`},
+		{`{{parseDuration . | formatDuration}}`, `1.5h`, `1h30m0s`},
+		{`{{(parseDuration .).Seconds}}`, `2m`, `120`},
+	}
+	tests.run(t, "parseDuration")
+
+	tmpl := template.Must(newTemplate("parseDuration").Parse(`{{parseDuration .}}`))
+	err := tmpl.Execute(ioutil.Discard, "30 seconds")
+	assert.Error(t, err)
+}
+
+func TestWhen(t *testing.T) {
+	context := struct {
+		BoolValue   bool
+		StringValue string
+	}{
+		true,
+		"foo",
+	}
+
+	tests := templateTestList{
+		{`{{ print (when .BoolValue "first" "second") }}`, context, `first`},
+		{`{{ print (when (eq .StringValue "foo") "first" "second") }}`, context, `first`},
+
+		{`{{ when (not .BoolValue) "first" "second" | print }}`, context, `second`},
+		{`{{ when (not (eq .StringValue "foo")) "first" "second" | print }}`, context, `second`},
+	}
+
+	tests.run(t, "when")
+}
+
+func TestWhenTrue(t *testing.T) {
+	if when(true, "first", "second") != "first" {
+		t.Fatal("Expected first value")
+
+	}
+}
+
+func TestWhenFalse(t *testing.T) {
+	if when(false, "first", "second") != "second" {
+		t.Fatal("Expected second value")
+	}
+}
+
+func TestSortByKeys(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"PROJECT": "shop",
+			},
+			Name: "web",
+			ID:   "1",
+		},
+		{
+			Env: map[string]string{
+				"PROJECT": "blog",
+			},
+			Name: "web",
+			ID:   "2",
+		},
+		{
+			Env: map[string]string{
+				"PROJECT": "shop",
+			},
+			Name: "db",
+			ID:   "3",
+		},
+		{
+			Name: "proxy",
+			ID:   "4",
+		},
+		{
+			Env: map[string]string{
+				"PROJECT": "blog",
+			},
+			Name: "db",
+			ID:   "5",
+		},
+		{
+			Env: map[string]string{
+				"PROJECT": "shop",
+			},
+			Name: "db",
+			ID:   "6",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range sortByKeys . "Env.PROJECT" "Name"}}{{.ID}}{{end}}`, containers, `452361`},
+		{`{{range sortByKeys . "Name" "Env.PROJECT"}}{{.ID}}{{end}}`, containers, `536421`},
+		{`{{range sortByKeys . "Env.PROJECT"}}{{.ID}}{{end}}`, containers, `425136`},
+		{`{{range sortByKeys . "Env.MISSING" "ID"}}{{.ID}}{{end}}`, containers, `123456`},
+	}
+
+	tests.run(t, "sortByKeys")
+
+	_, err := sortByKeys(containers)
+	assert.EqualError(t, err, "at least one key must be passed to 'sortByKeys' with an array or slice")
+	_, err = sortByKeys("not a slice", "Name")
+	assert.Error(t, err)
+}
+
+func TestSortByKeysMap(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo3.localhost",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range sortByKeys (groupBy . "Env.VIRTUAL_HOST")}}{{.Key}}:{{range .Value}}{{.ID}}{{end}} {{end}}`, containers, `demo1.localhost:24 demo2.localhost:1 demo3.localhost:3 `},
+		{`{{range sortByKeys (groupBy . "Env.MISSING")}}{{.Key}}{{end}}`, containers, ``},
+	}
+
+	tests.run(t, "sortByKeysMap")
+
+	sorted, err := sortByKeys(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []MapItem{}, sorted)
+
+	var groups map[string][]interface{}
+	sorted, err = sortByKeys(groups)
+	assert.NoError(t, err)
+	assert.Equal(t, []MapItem{}, sorted)
+
+	_, err = sortByKeys(map[string]string{"a": "b"}, "Key")
+	assert.EqualError(t, err, "keys cannot be passed to 'sortByKeys' with a map")
+}
+
+func TestSortObjectsByKeys(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo3.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "2",
+		},
+		{
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "4",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "5",
+		},
+		{
+			ID: "6",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range sortObjectsByKeys . "Env.VIRTUAL_HOST"}}{{.ID}}{{end}}`, containers, `362541`},
+		{`{{range sortObjectsByKeys . "ID"}}{{.ID}}{{end}}`, containers, `123456`},
+	}
+
+	tests.run(t, "sortObjectsByKeys")
+
+	// arbitrary slices are sorted too
+	hosts := []map[string]string{
+		{"host": "b.localhost"},
+		{"host": "a.localhost"},
+		{},
+	}
+	sorted, err := sortObjectsByKeys(hosts, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{hosts[2], hosts[1], hosts[0]}, sorted)
+
+	_, err = sortObjectsByKeys("not a slice", "host")
+	assert.Error(t, err)
+}
+
+func TestSortObjectsByKeyNumeric(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Labels: map[string]string{
+				"priority": "100",
+			},
+			ID: "1",
+		},
+		{
+			Labels: map[string]string{
+				"priority": "high",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"priority": "80",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+		{
+			Labels: map[string]string{
+				"priority": "-1.5",
+			},
+			ID: "5",
+		},
+		{
+			Labels: map[string]string{
+				"priority": "80",
+			},
+			ID: "6",
+		},
+		{
+			Labels: map[string]string{
+				"priority": "auto",
+			},
+			ID: "7",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range sortObjectsByKeyNumeric . "Labels.priority"}}{{.ID}}{{end}}`, containers, `5361472`},
+	}
+
+	tests.run(t, "sortObjectsByKeyNumeric")
+
+	sorted, err := sortObjectsByKeyNumeric([]struct{ Port int }{{443}, {80}, {8080}}, "Port")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{struct{ Port int }{80}, struct{ Port int }{443}, struct{ Port int }{8080}}, sorted)
+
+	_, err = sortObjectsByKeyNumeric("foo", "Port")
+	assert.Error(t, err)
+}
+
+func TestDefaultIfEmpty(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range defaultIfEmpty (split "placeholder" ",") (where . "Env.VIRTUAL_HOST" "none")}}{{.}}{{end}}`, containers, `placeholder`},
+		{`{{range defaultIfEmpty (split "placeholder" ",") (where . "Env.VIRTUAL_HOST" "demo1.localhost")}}{{.ID}}{{end}}`, containers, `1`},
+	}
+
+	tests.run(t, "defaultIfEmpty")
+
+	fallback := []string{"fallback"}
+	assert.Equal(t, fallback, defaultIfEmpty(fallback, nil))
+	assert.Equal(t, fallback, defaultIfEmpty(fallback, []string{}))
+	assert.Equal(t, fallback, defaultIfEmpty(fallback, map[string]string{}))
+	assert.Equal(t, fallback, defaultIfEmpty(fallback, &Context{}))
+	assert.Equal(t, []string{"value"}, defaultIfEmpty(fallback, []string{"value"}))
+}
+
+func TestDirList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+
+	files := map[string]string{
+		"aaa": "",
+		"bbb": "",
+		"ccc": "",
+	}
+	// Create temporary files
+	for key := range files {
+		file, err := ioutil.TempFile(dir, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		files[key] = file.Name()
+	}
+
+	expected := []string{
+		path.Base(files["aaa"]),
+		path.Base(files["bbb"]),
+		path.Base(files["ccc"]),
+	}
+
+	filesList, _ := dirList(dir)
+	assert.Equal(t, expected, filesList)
+
+	filesList, _ = dirList("/wrong/path")
+	assert.Equal(t, []string{}, filesList)
+}
+
+func TestPathHelpers(t *testing.T) {
+	tests := templateTestList{
+		{`{{base "/etc/nginx/certs/cert.pem"}}`, nil, `cert.pem`},
+		{`{{base "/etc/nginx/certs/"}}`, nil, `certs`},
+		{`{{base "cert"}}`, nil, `cert`},
+		{`{{dirname "/etc/nginx/certs/cert.pem"}}`, nil, `/etc/nginx/certs`},
+		{`{{dirname "/etc/nginx/certs/"}}`, nil, `/etc/nginx/certs`},
+		{`{{dirname "cert.pem"}}`, nil, `.`},
+		{`{{ext "/etc/nginx/certs/cert.pem"}}`, nil, `.pem`},
+		{`{{ext "/etc/nginx/certs/example.com.crt"}}`, nil, `.crt`},
+		{`{{ext "/etc/nginx/certs/cert"}}`, nil, ``},
+		{`{{ext "/etc/nginx/certs/"}}`, nil, ``},
+	}
+
+	tests.run(t, "pathHelpers")
+}
+
+func TestHasContainers(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{if hasContainers .}}yes{{else}}no{{end}}`, containers, `yes`},
+		{`{{if hasContainers (where . "Env.VIRTUAL_HOST" "demo1.localhost")}}yes{{else}}no{{end}}`, containers, `yes`},
+		{`{{if hasContainers (where . "Env.VIRTUAL_HOST" "demo2.localhost")}}yes{{else}}no{{end}}`, containers, `no`},
+		{`{{if hasContainers .}}yes{{else}}no{{end}}`, []*RuntimeContainer{}, `no`},
+		{`{{if hasContainers .}}yes{{else}}no{{end}}`, nil, `no`},
+		{`{{if hasContainers .}}yes{{else}}no{{end}}`, "demo1.localhost", `no`},
+	}
+
+	tests.run(t, "hasContainers")
+
+	var context *Context
+	assert.False(t, hasContainers(context))
+	assert.True(t, hasContainers(&Context{containers[0]}))
+}
+
+func TestToMap(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost",
+			},
+			ID: "2",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost",
+			},
+			ID: "3",
+		},
+		{
+			ID: "4",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{$m := toMap . "ID"}}{{len $m}} {{(index $m "2").Env.VIRTUAL_HOST}}`, containers, `4 demo2.localhost`},
+		{`{{$m := toMap . "Env.VIRTUAL_HOST"}}{{len $m}} {{(index $m "demo1.localhost").ID}} {{(index $m "demo2.localhost").ID}}`, containers, `2 3 2`},
+		{`{{range $k, $v := toMap . "Env.MISSING"}}{{$k}}{{end}}`, containers, ``},
+	}
+
+	tests.run(t, "toMap")
+
+	_, err := toMap("not a slice", "ID")
+	assert.Error(t, err)
+}
+
+func TestHostsForLabel(t *testing.T) {
+	containers := []*RuntimeContainer{
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo2.localhost, demo1.localhost",
+			},
+			Labels: map[string]string{
+				"com.example.tier": "frontend",
+			},
+			ID: "1",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "demo1.localhost,demo3.localhost,",
+			},
+			Labels: map[string]string{
+				"com.example.tier": "frontend-canary",
+			},
+			ID: "2",
+		},
+		{
+			Labels: map[string]string{
+				"com.example.tier": "frontend",
+			},
+			ID: "3",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "admin.localhost",
+			},
+			Labels: map[string]string{
+				"com.example.tier": "backend",
+			},
+			ID: "4",
+		},
+		{
+			Env: map[string]string{
+				"VIRTUAL_HOST": "other.localhost",
+			},
+			ID: "5",
+		},
+	}
+
+	tests := templateTestList{
+		{`{{range hostsForLabel . "com.example.tier" "^frontend"}}{{.}} {{end}}`, containers, `demo1.localhost demo2.localhost demo3.localhost `},
+		{`{{range hostsForLabel . "com.example.tier" "^backend$"}}{{.}}{{end}}`, containers, `admin.localhost`},
+		{`{{len (hostsForLabel . "com.example.tier" "^database$")}}`, containers, `0`},
+	}
+
+	tests.run(t, "hostsForLabel")
+
+	_, err := hostsForLabel(containers, "com.example.tier", "")
+	assert.Error(t, err)
+}
+
+func TestNormalizePort(t *testing.T) {
+	tests := templateTestList{
+		{`{{normalizePort "80"}}`, nil, `80`},
+		{`{{normalizePort " 443 "}}`, nil, `443`},
+		{`{{normalizePort "8080/tcp"}}`, nil, `8080`},
+		{`{{if lt (normalizePort "8080/tcp") (normalizePort "10000")}}lower{{end}}`, nil, `lower`},
+	}
+
+	tests.run(t, "normalizePort")
+
+	for _, input := range []string{"", "http", "80a", "/tcp", "-1", "0", "65536", "80/", "80/tcp/udp"} {
+		_, err := normalizePort(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestUpstreamName(t *testing.T) {
+	valid := regexp.MustCompile("^[a-z_][a-z0-9_]*$")
+
+	name := upstreamName("Demo1.localhost", "/api/v1")
+	assert.Regexp(t, valid, name)
+	assert.True(t, strings.HasPrefix(name, "demo1_localhost_api_v1_"), name)
+	assert.Equal(t, name, upstreamName("Demo1.localhost", "/api/v1"))
+
+	// parts which normalize to the same name get distinct suffixes
+	assert.NotEqual(t, name, upstreamName("demo1.localhost", "/api/v1"))
+	assert.NotEqual(t, upstreamName("a_b", "c"), upstreamName("a", "b_c"))
+
+	for _, parts := range [][]string{{}, {""}, {"/"}, {"8080.localhost"}, {"ünïcode.localhost"}} {
+		assert.Regexp(t, valid, upstreamName(parts...), parts)
+	}
+
+	tests := templateTestList{
+		{`{{upstreamName "demo1.localhost" "/"}}`, nil, upstreamName("demo1.localhost", "/")},
+	}
+
+	tests.run(t, "upstreamName")
+}
+
+func TestCoalesce(t *testing.T) {
+	v := coalesce(nil, "second", "third")
+	assert.Equal(t, "second", v, "Expected second value")
+
+	v = coalesce(nil, nil, nil)
+	assert.Nil(t, v, "Expected nil value")
+}
+
+func TestGenerateFileResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}\n{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+		Diff:     true,
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+		{ID: "2", State: State{Running: true}},
+	}
+
+	result := GenerateFileResult(config, containers)
+	assert.True(t, result.Changed)
+	assert.Equal(t, 4, result.BytesWritten)
+	assert.Equal(t, config.Dest, result.Dest)
+	assert.Contains(t, result.Diff, "+1\n+2\n")
+
+	result = GenerateFileResult(config, containers[:1])
+	assert.True(t, result.Changed)
+	assert.Contains(t, result.Diff, " 1\n-2\n")
+
+	result = GenerateFileResult(config, containers[:1])
+	assert.False(t, result.Changed)
+	assert.Equal(t, 0, result.BytesWritten)
+	assert.Empty(t, result.Diff)
+}
+
+func TestGenerateFileContinueOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{index . 5}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "test.out"), []byte("previous\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template:        tmplPath,
+		Dest:            path.Join(dir, "test.out"),
+		ContinueOnError: true,
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+	}
+
+	result := GenerateFileResult(config, containers)
+	assert.Error(t, result.Err)
+	assert.False(t, result.Changed)
+	contents, _ := ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "previous\n", string(contents))
+
+	// timeouts are never fatal
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{range $}}{{range $}}{{range $}}{{.ID}}{{end}}{{end}}{{end}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		containers = append(containers, &RuntimeContainer{ID: "1", State: State{Running: true}})
+	}
+	config = Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+		Timeout:  Duration(time.Millisecond),
+	}
+	result = GenerateFileResult(config, containers)
+	assert.IsType(t, timeoutError{}, result.Err)
+	assert.False(t, result.Changed)
+	contents, _ = ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "previous\n", string(contents))
+}
+
+func TestGenerateFileEmitDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}\n{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+		EmitDiff: true,
+	}
+	containers := Context{}
+	for i := 1; i <= 20; i++ {
+		containers = append(containers, &RuntimeContainer{ID: fmt.Sprint(i), State: State{Running: true}})
+	}
+
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	assert.True(t, GenerateFile(config, containers[:19]))
+	buf.Reset()
+
+	// only the added line and its context are logged
+	assert.True(t, GenerateFile(config, containers))
+	assert.Contains(t, buf.String(), "Changes to '"+config.Dest+"'")
+	assert.Contains(t, buf.String(), "@@ -17,3 +17,4 @@\n 17\n 18\n 19\n+20\n")
+	assert.NotContains(t, buf.String(), " 16\n")
+
+	buf.Reset()
+	assert.False(t, GenerateFile(config, containers))
+	assert.NotContains(t, buf.String(), "Changes to")
+}
+
+func TestExecuteTemplateTimeout(t *testing.T) {
+	tmplFile, err := ioutil.TempFile("", "docker-gen-tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmplFile.Name())
+
+	_, err = tmplFile.WriteString("{{range .}}{{range $}}{{.ID}}{{end}}{{end}}")
+	tmplFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers := Context{
+		&RuntimeContainer{ID: "0"},
+		&RuntimeContainer{ID: "1"},
+	}
+
+	contents, err := executeTemplate(Config{Template: tmplFile.Name()}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "0101", string(contents))
+
+	contents, err = executeTemplate(Config{Template: tmplFile.Name(), Timeout: Duration(time.Minute)}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "0101", string(contents))
+
+	// executions are skipped while an abandoned one still runs
+	running := make(chan struct{})
+	abandonedRenders.Store(tmplFile.Name(), (<-chan struct{})(running))
+	_, err = executeTemplate(Config{Template: tmplFile.Name(), Timeout: Duration(time.Minute)}, containers)
+	assert.Equal(t, timeoutError{template: tmplFile.Name(), timeout: time.Minute, running: true}, err)
+	close(running)
+	contents, err = executeTemplate(Config{Template: tmplFile.Name(), Timeout: Duration(time.Minute)}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "0101", string(contents))
+
+	// render errors are returned, with or without a timeout
+	if err := ioutil.WriteFile(tmplFile.Name(), []byte("{{index . 5}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = executeTemplate(Config{Template: tmplFile.Name()}, containers)
+	assert.Error(t, err)
+	_, err = executeTemplate(Config{Template: tmplFile.Name(), Timeout: Duration(time.Minute)}, containers)
+	assert.Error(t, err)
+
+	// a template function blocking past the timeout
+	release := make(chan struct{})
+	defer close(release)
+	tmpl := template.Must(newTemplate("blocking").Funcs(template.FuncMap{
+		"wait": func() string {
+			<-release
+			return ""
+		},
+	}).Parse("{{range .}}{{wait}}{{.}}{{end}}"))
+
+	_, finished, err := renderWithTimeout(tmpl, "blocking", []int{1, 2, 3}, 10*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	select {
+	case <-finished:
+		t.Error("Expected the abandoned rendering to still run")
+	default:
+	}
+}
+
+func TestRenderTemplateCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	tmpl := template.Must(newTemplate("cancel").Funcs(template.FuncMap{
+		"cancel": func() string {
+			calls++
+			cancel()
+			return ""
+		},
+	}).Parse("{{range .}}{{.}}{{cancel}}{{end}}"))
+
+	// the rendering stops at the first write once the context is done
+	contents, err := renderTemplate(ctx, tmpl, "cancel", []int{1, 2, 3})
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, contents)
+	assert.Equal(t, 1, calls)
+
+	tmpl = template.Must(newTemplate("error").Parse(`{{index . 5}}`))
+	_, err = renderTemplate(context.Background(), tmpl, "error", []int{1})
+	assert.Error(t, err)
+	assert.NotEqual(t, context.Canceled, err)
+}
+
+func TestGenerateFileSkipIfEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
-	buf := bytes.NewBufferString(output)
-	dec := json.NewDecoder(buf)
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}\n"), 0644)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var decoded []*RuntimeContainer
-	if err := dec.Decode(&decoded); err != nil {
+	destPath := path.Join(dir, "test.out")
+	err = ioutil.WriteFile(destPath, []byte("good config"), 0644)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if len(decoded) != len(containers) {
-		t.Fatalf("Incorrect unmarshaled container count. Expected %d, got %d.", len(containers), len(decoded))
+
+	config := Config{
+		Template:    tmplPath,
+		Dest:        destPath,
+		SkipIfEmpty: true,
 	}
+
+	assert.False(t, GenerateFile(config, Context{}))
+	contents, _ := ioutil.ReadFile(destPath)
+	assert.Equal(t, "good config", string(contents))
+
+	config.SkipIfEmpty = false
+	assert.True(t, GenerateFile(config, Context{}))
+	contents, _ = ioutil.ReadFile(destPath)
+	assert.Equal(t, "", string(contents))
 }
 
-func TestParseJson(t *testing.T) {
-	tests := templateTestList{
-		{`{{parseJson .}}`, `null`, `<no value>`},
-		{`{{parseJson .}}`, `true`, `true`},
-		{`{{parseJson .}}`, `1`, `1`},
-		{`{{parseJson .}}`, `0.5`, `0.5`},
-		{`{{index (parseJson .) "enabled"}}`, `{"enabled":true}`, `true`},
-		{`{{index (parseJson . | first) "enabled"}}`, `[{"enabled":true}]`, `true`},
+func TestGenerateFileMinContainers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
-	tests.run(t, "parseJson")
-}
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestQueryEscape(t *testing.T) {
-	tests := templateTestList{
-		{`{{queryEscape .}}`, `example.com`, `example.com`},
-		{`{{queryEscape .}}`, `.example.com`, `.example.com`},
-		{`{{queryEscape .}}`, `*.example.com`, `%2A.example.com`},
-		{`{{queryEscape .}}`, `~^example\.com(\..*\.xip\.io)?$`, `~%5Eexample%5C.com%28%5C..%2A%5C.xip%5C.io%29%3F%24`},
+	config := Config{
+		Template:      tmplPath,
+		Dest:          path.Join(dir, "test.out"),
+		MinContainers: 2,
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+		{ID: "2", State: State{Running: true}},
+		{ID: "3", State: State{Running: false}},
 	}
 
-	tests.run(t, "queryEscape")
+	assert.True(t, GenerateFile(config, containers))
+	contents, _ := ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "12", string(contents))
+
+	assert.False(t, GenerateFile(config, containers[1:]))
+	contents, _ = ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "12", string(contents))
 }
 
-func TestArrayClosestExact(t *testing.T) {
-	if arrayClosest([]string{"foo.bar.com", "bar.com"}, "foo.bar.com") != "foo.bar.com" {
-		t.Fatal("Expected foo.bar.com")
+func TestGenerateFileTrimTrailingWhitespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("upstream {  \n{{range .}}  server {{.ID}};\t\r\n{{end}}}  \n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+		{ID: "2", State: State{Running: true}},
 	}
+
+	assert.True(t, GenerateFile(config, containers))
+	contents, _ := ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "upstream {  \n  server 1;\t\r\n  server 2;\t\r\n}  \n", string(contents))
+
+	config.TrimTrailingWhitespace = true
+	assert.True(t, GenerateFile(config, containers))
+	contents, _ = ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "upstream {\n  server 1;\r\n  server 2;\r\n}\n", string(contents))
 }
 
-func TestArrayClosestSubstring(t *testing.T) {
-	if arrayClosest([]string{"foo.fo.com", "bar.com"}, "foo.bar.com") != "bar.com" {
-		t.Fatal("Expected bar.com")
+func TestGenerateFileForceWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+	}
+
+	assert.True(t, GenerateFile(config, containers))
+	assert.False(t, GenerateFile(config, containers))
+
+	before, err := os.Stat(config.Dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.ForceWrite = true
+	result := GenerateFileResult(config, containers)
+	assert.True(t, result.Changed)
+	assert.Equal(t, 1, result.BytesWritten)
+
+	after, err := os.Stat(config.Dest)
+	if err != nil {
+		t.Fatal(err)
 	}
+	assert.False(t, os.SameFile(before, after), "the destination file should have been replaced")
+	contents, _ := ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "1", string(contents))
 }
 
-func TestArrayClosestNoMatch(t *testing.T) {
-	if arrayClosest([]string{"foo.fo.com", "bip.com"}, "foo.bar.com") != "" {
-		t.Fatal("Expected ''")
+func TestGenerateFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	config := Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+		FileMode: 0640,
+		FileUID:  &uid,
+		FileGID:  &gid,
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+	}
+
+	// a new destination file gets the explicit mode
+	assert.True(t, GenerateFile(config, containers))
+	fi, err := os.Stat(config.Dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// so does an existing one with another mode, when rewritten
+	if err := os.Chmod(config.Dest, 0600); err != nil {
+		t.Fatal(err)
+	}
+	containers = append(containers, &RuntimeContainer{ID: "2", State: State{Running: true}})
+	assert.True(t, GenerateFile(config, containers))
+	fi, _ = os.Stat(config.Dest)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// or left untouched
+	if err := os.Chmod(config.Dest, 0600); err != nil {
+		t.Fatal(err)
 	}
+	assert.False(t, GenerateFile(config, containers))
+	fi, _ = os.Stat(config.Dest)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	assert.Equal(t, uint32(uid), fi.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint32(gid), fi.Sys().(*syscall.Stat_t).Gid)
+
+	// without an explicit mode, the one of the existing file is kept
+	config.FileMode = 0
+	if err := os.Chmod(config.Dest, 0600); err != nil {
+		t.Fatal(err)
+	}
+	containers = containers[:1]
+	assert.True(t, GenerateFile(config, containers))
+	fi, _ = os.Stat(config.Dest)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
 }
 
-func TestWhen(t *testing.T) {
-	context := struct {
-		BoolValue   bool
-		StringValue string
+func TestGenerateFileNameRegex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.Name}} {{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers := Context{
+		{Name: "tenant-a-web", State: State{Running: true}},
+		{Name: "tenant-a-db", State: State{Running: true}},
+		{Name: "tenant-b-web", State: State{Running: true}},
+		{Name: "proxy", State: State{Running: true}},
+	}
+
+	tests := []struct {
+		include, exclude string
+		expected         string
 	}{
-		true,
-		"foo",
+		{"", "", "tenant-a-web tenant-a-db tenant-b-web proxy "},
+		{"^tenant-a-", "", "tenant-a-web tenant-a-db "},
+		{"", "-db$", "tenant-a-web tenant-b-web proxy "},
+		{"^tenant-", "-db$", "tenant-a-web tenant-b-web "},
+		{"^tenant-a-", "^tenant-", ""},
 	}
 
-	tests := templateTestList{
-		{`{{ print (when .BoolValue "first" "second") }}`, context, `first`},
-		{`{{ print (when (eq .StringValue "foo") "first" "second") }}`, context, `first`},
+	for _, test := range tests {
+		config := Config{
+			Template:         tmplPath,
+			Dest:             path.Join(dir, "test.out"),
+			IncludeNameRegex: test.include,
+			ExcludeNameRegex: test.exclude,
+			ForceWrite:       true,
+		}
+		result := GenerateFileResult(config, containers)
+		assert.NoError(t, result.Err)
+		contents, _ := ioutil.ReadFile(config.Dest)
+		assert.Equal(t, test.expected, string(contents), "include %q, exclude %q", test.include, test.exclude)
+	}
 
-		{`{{ when (not .BoolValue) "first" "second" | print }}`, context, `second`},
-		{`{{ when (not (eq .StringValue "foo")) "first" "second" | print }}`, context, `second`},
+	config := Config{
+		Template:         tmplPath,
+		Dest:             path.Join(dir, "test.out"),
+		ExcludeNameRegex: "(unclosed",
 	}
+	result := GenerateFileResult(config, containers)
+	assert.Error(t, result.Err)
+	assert.False(t, result.Changed)
+}
 
-	tests.run(t, "when")
+func TestGenerateFileSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template:    tmplPath,
+		Dest:        path.Join(dir, "test.out"),
+		SummaryDest: path.Join(dir, "summary.json"),
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}},
+		{ID: "2", State: State{Running: true}},
+	}
+
+	readSummary := func() GenerateSummary {
+		var summary GenerateSummary
+		b, err := ioutil.ReadFile(config.SummaryDest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &summary); err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	assert.True(t, GenerateFile(config, containers))
+	summary := readSummary()
+	assert.Equal(t, config.Dest, summary.Dest)
+	assert.Equal(t, 2, summary.Containers)
+	assert.Equal(t, "6b51d431df5d7f141cbececcf79edf3dd861c3b4069f0b11661a3eefacbba918", summary.Hash)
+	assert.True(t, summary.Changed)
+	assert.WithinDuration(t, time.Now(), summary.Timestamp, time.Minute)
+
+	assert.False(t, GenerateFile(config, containers))
+	assert.False(t, readSummary().Changed)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 3, "temp files should be removed")
+
+	config.SummaryDest = ""
+	os.Remove(path.Join(dir, "summary.json"))
+	GenerateFile(config, containers)
+	_, err = os.Stat(path.Join(dir, "summary.json"))
+	assert.True(t, os.IsNotExist(err))
 }
 
-func TestWhenTrue(t *testing.T) {
-	if when(true, "first", "second") != "first" {
-		t.Fatal("Expected first value")
+func TestGenerateFileConcurrentDest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte("{{range .}}{{.ID}}\n{{end}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template: tmplPath,
+		Dest:     path.Join(dir, "test.out"),
+	}
+	outputs := []Context{
+		{{ID: "1", State: State{Running: true}}, {ID: "2", State: State{Running: true}}},
+		{{ID: "3", State: State{Running: true}}},
+	}
 
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(containers Context) {
+			defer wg.Done()
+			GenerateFile(config, containers)
+		}(outputs[i%len(outputs)])
 	}
+	wg.Wait()
+
+	contents, _ := ioutil.ReadFile(config.Dest)
+	assert.Contains(t, []string{"1\n2\n", "3\n"}, string(contents))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2, "temp files should be removed")
 }
 
-func TestWhenFalse(t *testing.T) {
-	if when(false, "first", "second") != "second" {
-		t.Fatal("Expected second value")
+func TestGenerateFileMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte(`{{range .}}{{$m := metadata .}}{{.ID}}={{index $m "com.example.role"}},{{index $m "com.example.tier"}};{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "1.json"), []byte(`{"com.example.role": "primary", "com.example.tier": "db"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Template:    tmplPath,
+		Dest:        path.Join(dir, "test.out"),
+		MetadataDir: dir,
+	}
+	containers := Context{
+		{ID: "1", State: State{Running: true}, Labels: map[string]string{"com.example.role": "replica", "com.example.zone": "a"}},
+		{ID: "2", State: State{Running: true}, Labels: map[string]string{"com.example.tier": "web"}},
+	}
+
+	assert.True(t, GenerateFile(config, containers))
+	contents, _ := ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "1=primary,db;2=,web;", string(contents))
+
+	labels, err := metadata(dir)(containers[0])
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"com.example.role": "primary", "com.example.tier": "db", "com.example.zone": "a"}, labels)
+	assert.Equal(t, "replica", containers[0].Labels["com.example.role"], "container labels should not be modified")
+
+	// containers returned by groupBy and where are values
+	err = ioutil.WriteFile(tmplPath, []byte(`{{range $id, $c := groupBy $ "ID"}}{{range $c}}{{.ID}}={{index (metadata .) "com.example.tier"}};{{end}}{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, GenerateFile(config, containers))
+	contents, _ = ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "1=db;2=web;", string(contents))
+	_, err = metadata(dir)("1")
+	assert.Error(t, err)
+
+	// and so does tpl
+	err = ioutil.WriteFile(tmplPath, []byte(`{{range .}}{{tpl "{{index (metadata .) \"com.example.role\"}};" .}}{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, GenerateFile(config, containers))
+	contents, _ = ioutil.ReadFile(config.Dest)
+	assert.Equal(t, "primary;;", string(contents))
+
+	err = ioutil.WriteFile(path.Join(dir, "2.json"), []byte(`not json`), 0644)
+	if err != nil {
+		t.Fatal(err)
 	}
+	_, err = metadata(dir)(containers[1])
+	assert.Error(t, err)
+
+	labels, err = metadata("")(containers[0])
+	assert.NoError(t, err)
+	assert.Equal(t, containers[0].Labels, labels)
 }
 
-func TestDirList(t *testing.T) {
-	dir, err := ioutil.TempDir("", "dirList")
+func TestValidateTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(dir)
+	defer os.RemoveAll(dir)
 
-	files := map[string]string{
-		"aaa": "",
-		"bbb": "",
-		"ccc": "",
+	tests := []struct {
+		tmpl  string
+		valid bool
+	}{
+		{`{{range whereLabelValueMatches $ "com.example.tier" "^front"}}{{.ID}}{{end}}`, true},
+		{`{{if gt (len (whereLabelValueMatches $ "com.example.tier" "^front")) 0}}{{end}}`, true},
+		{`{{define "hosts"}}{{range .}}{{.Env.VIRTUAL_HOST}}{{end}}{{end}}{{template "hosts" $}}`, true},
+		{`{{$pattern := "(unclosed"}}{{range whereLabelValueMatches $ "com.example.tier" $pattern}}{{.ID}}{{end}}`, false},
+		{`{{range whereLabelValueMatches $ "com.example.tier" "(unclosed"}}{{.ID}}{{end}}`, false},
+		{`{{if true}}{{else}}{{range whereLabelValueMatchesExcept $ "tier" "^front" "[z-a]"}}{{end}}{{end}}`, false},
+		{`{{with (compileRegex "*")}}{{end}}`, false},
+		{`{{define "hosts"}}{{range whereEnvValueMatches . "VIRTUAL_HOST" "(demo"}}{{end}}{{end}}`, false},
+		{`{{countLabelValueMatches $ "a(b" "x"}}`, true},
+		{`{{if true}}{{else}}{{countLabelValueMatches $ "tier" "a(b"}}{{end}}`, false},
+		{`{{if false}}{{-1 | regexFindAll "(" "abc"}}{{end}}`, false},
+		{`{{if false}}{{"x" | labelValueMatches $ "l" "("}}{{end}}`, false},
+		{`{{if false}}{{"x" | labelValueMatches $ "l" "^x"}}{{end}}`, true},
+		{`{{if true}}{{else}}{{$ | countLabelValueMatches "a(b" "x"}}{{end}}`, true},
+		{`{{if true}}{{else}}{{"" | compileRegex}}{{end}}`, true},
+		{`{{range .}}{{.ID}}`, false},
+		{`{{range noSuchFunction .}}{{end}}`, false},
+		{`{{index (dict) "key" | len}}`, false},
 	}
-	// Create temporary files
-	for key := range files {
-		file, err := ioutil.TempFile(dir, key)
+
+	for i, test := range tests {
+		tmplPath := path.Join(dir, fmt.Sprintf("test-%d.tmpl", i))
+		err = ioutil.WriteFile(tmplPath, []byte(test.tmpl), 0644)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer os.Remove(file.Name())
-		files[key] = file.Name()
+
+		err := ValidateTemplate(Config{Template: tmplPath})
+		if test.valid {
+			assert.NoError(t, err, test.tmpl)
+		} else {
+			assert.Error(t, err, test.tmpl)
+		}
 	}
 
-	expected := []string{
-		path.Base(files["aaa"]),
-		path.Base(files["bbb"]),
-		path.Base(files["ccc"]),
+	err = ValidateTemplate(Config{Template: path.Join(dir, "missing.tmpl")})
+	assert.Error(t, err)
+}
+
+func TestIsAllowedHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-gen")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
-	filesList, _ := dirList(dir)
-	assert.Equal(t, expected, filesList)
+	tmplPath := path.Join(dir, "test.tmpl")
+	err = ioutil.WriteFile(tmplPath, []byte(`{{range $c := .}}{{with $c.Env.VIRTUAL_HOST}}{{if isAllowedHost .}}{{$c.ID}}{{end}}{{end}}{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostsPath := path.Join(dir, "allowed-hosts")
+	err = ioutil.WriteFile(hostsPath, []byte("# allowed hosts\ndemo1.localhost\n\n  Demo3.localhost  \n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	filesList, _ = dirList("/wrong/path")
-	assert.Equal(t, []string{}, filesList)
-}
+	containers := Context{
+		{Env: map[string]string{"VIRTUAL_HOST": "demo1.localhost"}, ID: "1"},
+		{Env: map[string]string{"VIRTUAL_HOST": "demo2.localhost"}, ID: "2"},
+		{Env: map[string]string{"VIRTUAL_HOST": "demo3.localhost"}, ID: "3"},
+		{Env: map[string]string{"VIRTUAL_PORT": "80"}, ID: "4"},
+	}
 
-func TestCoalesce(t *testing.T) {
-	v := coalesce(nil, "second", "third")
-	assert.Equal(t, "second", v, "Expected second value")
+	contents, err := executeTemplate(Config{Template: tmplPath, AllowedHostsFile: hostsPath}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "13", string(contents))
 
-	v = coalesce(nil, nil, nil)
-	assert.Nil(t, v, "Expected nil value")
+	// the file is parsed again once modified
+	err = ioutil.WriteFile(hostsPath, []byte("demo2.localhost\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(hostsPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = executeTemplate(Config{Template: tmplPath, AllowedHostsFile: hostsPath}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(contents))
+
+	// templates rendered by tpl see the same file
+	tplPath := path.Join(dir, "tpl.tmpl")
+	err = ioutil.WriteFile(tplPath, []byte(`{{range .}}{{tpl "{{with .Env.VIRTUAL_HOST}}{{if isAllowedHost .}}{{.}}{{end}}{{end}}" .}}{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err = executeTemplate(Config{Template: tplPath, AllowedHostsFile: hostsPath}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "demo2.localhost", string(contents))
+
+	// no host is allowed when the file is missing
+	contents, err = executeTemplate(Config{Template: tmplPath, AllowedHostsFile: path.Join(dir, "missing")}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(contents))
+
+	// and every host without a file
+	contents, err = executeTemplate(Config{Template: tmplPath}, containers)
+	assert.NoError(t, err)
+	assert.Equal(t, "123", string(contents))
 }
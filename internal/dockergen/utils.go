@@ -2,6 +2,7 @@ package dockergen
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
 	"strings"
@@ -81,3 +82,145 @@ func pathExists(path string) (bool, error) {
 	}
 	return false, err
 }
+
+// diffContext is the number of unchanged lines around the changes of a hunk
+const diffContext = 3
+
+// diffOp is a line of an edit script: kept (' '), deleted ('-') or added ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the differences between old and new as a unified diff
+// with diffContext lines of context around every hunk, or an empty string when
+// they are equal. Lines are matched using their longest common subsequence.
+func unifiedDiff(name string, old, new []byte) string {
+	ops := diffLines(splitLines(string(old)), splitLines(string(new)))
+
+	// oldPos[k] and newPos[k] are the numbers of old and new lines before ops[k]
+	oldPos := make([]int, len(ops)+1)
+	newPos := make([]int, len(ops)+1)
+	changes := []int{}
+	for k, op := range ops {
+		oldPos[k+1], newPos[k+1] = oldPos[k], newPos[k]
+		if op.kind != '+' {
+			oldPos[k+1]++
+		}
+		if op.kind != '-' {
+			newPos[k+1]++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, k)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", name, name)
+	for c := 0; c < len(changes); {
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// merge the changes separated by at most twice the context
+		last := changes[c]
+		for c++; c < len(changes) && changes[c]-last <= 2*diffContext+1; c++ {
+			last = changes[c]
+		}
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(oldPos[start], oldPos[end]), hunkRange(newPos[start], newPos[end]))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line + "\n")
+		}
+	}
+	return buf.String()
+}
+
+// hunkRange formats the lines [from, to) of a hunk header. An empty range is
+// given by the line before it.
+func hunkRange(from, to int) string {
+	if from == to {
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// diffLines returns an edit script turning a into b. Only the lines between
+// the common prefix and suffix are compared, and in every run of changes the
+// deletions come before the additions.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	// lcs[i][j] holds the length of the longest common subsequence of ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var deleted, added []diffOp
+	flush := func() {
+		ops = append(append(ops, deleted...), added...)
+		deleted, added = deleted[:0], added[:0]
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			flush()
+			ops = append(ops, diffOp{' ', ma[i]})
+			i++
+			j++
+		case j < len(mb) && (i == len(ma) || lcs[i][j+1] > lcs[i+1][j]):
+			added = append(added, diffOp{'+', mb[j]})
+			j++
+		default:
+			deleted = append(deleted, diffOp{'-', ma[i]})
+			i++
+		}
+	}
+	flush()
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -2,6 +2,7 @@ package dockergen
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -137,3 +138,148 @@ func TestRemoveBlankLines(t *testing.T) {
 		}
 	}
 }
+
+func TestUnifiedDiff(t *testing.T) {
+	old := []byte("upstream a\nserver 1\nserver 2\n")
+	new := []byte("upstream a\nserver 2\nserver 3\n")
+
+	expected := `--- dest.conf
++++ dest.conf
+@@ -1,3 +1,3 @@
+ upstream a
+-server 1
+ server 2
++server 3
+`
+	if got := unifiedDiff("dest.conf", old, new); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+
+	// an empty range is given by the line before it
+	expected = `--- dest.conf
++++ dest.conf
+@@ -0,0 +1,1 @@
++foo
+`
+	if got := unifiedDiff("dest.conf", []byte{}, []byte("foo\n")); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+	expected = `--- dest.conf
++++ dest.conf
+@@ -1,1 +0,0 @@
+-foo
+`
+	if got := unifiedDiff("dest.conf", []byte("foo\n"), []byte{}); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+
+	if got := unifiedDiff("dest.conf", old, old); got != "" {
+		t.Fatalf("Incorrect diff; expected no diff, got %q", got)
+	}
+}
+
+func TestUnifiedDiffDeletionsFirst(t *testing.T) {
+	old := []byte("a\nb\nc\nd\n")
+	new := []byte("a\nx\ny\nd\n")
+
+	expected := `--- dest.conf
++++ dest.conf
+@@ -1,4 +1,4 @@
+ a
+-b
+-c
++x
++y
+ d
+`
+	if got := unifiedDiff("dest.conf", old, new); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	lines := func(from, to int) []string {
+		result := []string{}
+		for i := from; i <= to; i++ {
+			result = append(result, fmt.Sprintf("line %d", i))
+		}
+		return result
+	}
+	join := func(parts ...[]string) []byte {
+		all := []string{}
+		for _, part := range parts {
+			all = append(all, part...)
+		}
+		return []byte(strings.Join(all, "\n") + "\n")
+	}
+
+	// changes at lines 5 and 30 of 40 give two hunks with 3 lines of context
+	old := join(lines(1, 40))
+	new := join(lines(1, 4), []string{"changed 5"}, lines(6, 29), []string{"changed 30"}, lines(31, 40))
+
+	expected := `--- dest.conf
++++ dest.conf
+@@ -2,7 +2,7 @@
+ line 2
+ line 3
+ line 4
+-line 5
++changed 5
+ line 6
+ line 7
+ line 8
+@@ -27,7 +27,7 @@
+ line 27
+ line 28
+ line 29
+-line 30
++changed 30
+ line 31
+ line 32
+ line 33
+`
+	if got := unifiedDiff("dest.conf", old, new); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+
+	// changes separated by at most 6 unchanged lines share a hunk
+	new = join(lines(1, 4), []string{"changed 5"}, lines(6, 11), []string{"changed 12"}, lines(13, 40))
+	expected = `--- dest.conf
++++ dest.conf
+@@ -2,14 +2,14 @@
+ line 2
+ line 3
+ line 4
+-line 5
++changed 5
+ line 6
+ line 7
+ line 8
+ line 9
+ line 10
+ line 11
+-line 12
++changed 12
+ line 13
+ line 14
+ line 15
+`
+	if got := unifiedDiff("dest.conf", old, new); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+
+	// a line appended to a large file
+	old = join(lines(1, 5000))
+	new = join(lines(1, 5000), []string{"line 5001"})
+	expected = `--- dest.conf
++++ dest.conf
+@@ -4998,3 +4998,4 @@
+ line 4998
+ line 4999
+ line 5000
++line 5001
+`
+	if got := unifiedDiff("dest.conf", old, new); got != expected {
+		t.Fatalf("Incorrect diff; expected %q, got %q", expected, got)
+	}
+}